@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/kvalv/shoplist/dialect"
 	"github.com/kvalv/shoplist/events"
 )
 
@@ -47,13 +48,13 @@ func NewMockAuth(claims *Claims) func(http.Handler) http.Handler {
 func RegisterUsers(
 	db *sql.DB,
 	log *slog.Logger,
-	bus *events.Bus,
+	outbox *events.Outbox,
 ) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			claims := ClaimsFromRequest(r)
 
-			rows, err := db.Query("select * from users where user_id = ?", claims.UserID)
+			rows, err := db.Query(dialect.Of(db).Rebind("select * from users where user_id = ?"), claims.UserID)
 			if err != nil {
 				w.WriteHeader(500)
 				log.Error(fmt.Sprintf("failed to execute sql query: %v", err))
@@ -69,23 +70,41 @@ func RegisterUsers(
 				return
 			}
 
-			if _, err := db.Exec("insert into users(user_id, name, email, picture) values (?, ?, ?, ?)",
-				claims.UserID,
-				claims.Name,
-				claims.Email,
-				claims.Picture,
-			); err != nil {
+			// the worker creates a first cart for new users, so the event must
+			// not get lost if we crash right after the insert
+			if err := register(db, claims); err != nil {
 				log.Error(fmt.Sprintf("failed to insert user: %v", err))
 				w.WriteHeader(500)
 				return
 			}
-			bus.Publish(events.UserRegistered{UserID: claims.UserID})
+			outbox.Notify()
 			time.Sleep(time.Millisecond * 100)
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
+func register(db *sql.DB, claims *Claims) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(dialect.Of(db).Rebind("insert into users(user_id, name, email, picture) values (?, ?, ?, ?)"),
+		claims.UserID,
+		claims.Name,
+		claims.Email,
+		claims.Picture,
+	); err != nil {
+		return err
+	}
+	if _, err := events.Stage(tx, dialect.Of(db), events.UserRegistered{UserID: claims.UserID}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func withClaims(ctx context.Context, claims *Claims) context.Context {
 	return context.WithValue(ctx, ctxKey, claims)
 }
@@ -20,6 +20,10 @@ type Cart struct {
 
 	// Business logic related to clas ohlson is different than kiwi.
 	TargetStore stores.Store
+	// ShopID is which of the shops of the target store to shop at, e.g. a
+	// Clas Ohlson store ID. Empty for the one its creator prefers, see
+	// [Repository.ShopPreference], or else the default.
+	ShopID string
 }
 
 func (c *Cart) WithName(name string) *Cart {
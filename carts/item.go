@@ -3,7 +3,7 @@ package carts
 import (
 	"time"
 
-	"github.com/kvalv/shoplist/stores/clasohlson"
+	"github.com/kvalv/shoplist/stores"
 )
 
 type Item struct {
@@ -16,25 +16,69 @@ type Item struct {
 	UpdatedBy string
 	CreatedBy string
 
-	Clas *ClasSearch
+	// Search holds the products of the target store that may be what the
+	// item is about, found by its enricher.
+	Search *Search
+
+	// Enrichment is where the worker is at finding candidates for the item,
+	// nil if it was never asked to.
+	Enrichment *Enrichment
+
+	// changed is set when the item is checked or unchecked, so that
+	// [Repository.Save] knows to store it.
+	changed bool
+}
+
+type EnrichState string
+
+const (
+	EnrichQueued    EnrichState = "queued"
+	EnrichSearching EnrichState = "searching"
+	EnrichDone      EnrichState = "done"
+	EnrichFailed    EnrichState = "failed"   // given up on, see Error
+	EnrichNoMatch   EnrichState = "no match" // the store has nothing like it
+)
+
+type Enrichment struct {
+	State     EnrichState
+	Attempts  int
+	Error     string // of the last attempt, if it failed
+	UpdatedAt time.Time
+}
+
+// Pending tells whether the worker is yet to finish with the item.
+func (e *Enrichment) Pending() bool {
+	return e != nil && (e.State == EnrichQueued || e.State == EnrichSearching)
 }
 
 func (i *Item) Toggle(toggledBy string) *Item {
 	i.Checked = !i.Checked
 	i.UpdatedAt = time.Now()
 	i.UpdatedBy = toggledBy
+	i.changed = true
 	return i
 }
 
-type ClasSearch struct {
-	Candidates []clasohlson.Item
+type Search struct {
+	Store      stores.Store // the candidates are from
+	Candidates []stores.Candidate
 	Chosen     *int // index into Candidates
 }
 
-// Selected returns the chosen item, or nil if none selected
-func (c *ClasSearch) Selected() *clasohlson.Item {
-	if c == nil || c.Chosen == nil || *c.Chosen < 0 || *c.Chosen >= len(c.Candidates) {
+// SearchIn returns the candidates of the item if they are from the given
+// store, and nil if not. Those from another store are kept, in case the cart
+// is switched back, but are of no use in this one.
+func (i *Item) SearchIn(s stores.Store) *Search {
+	if i.Search == nil || i.Search.Store != s {
+		return nil
+	}
+	return i.Search
+}
+
+// Selected returns the chosen candidate, or nil if none selected
+func (s *Search) Selected() *stores.Candidate {
+	if s == nil || s.Chosen == nil || *s.Chosen < 0 || *s.Chosen >= len(s.Candidates) {
 		return nil
 	}
-	return &c.Candidates[*c.Chosen]
+	return &s.Candidates[*s.Chosen]
 }
@@ -0,0 +1,17 @@
+package carts
+
+import (
+	"database/sql"
+
+	"github.com/kvalv/shoplist/dialect"
+)
+
+// PostgresRepository stores carts in Postgres. It shares its queries with
+// [SqliteRepository]; the schema lives in migrations/postgres.sql.
+type PostgresRepository struct {
+	sqlRepository
+}
+
+func NewPostgresRepository(db *sql.DB) (*PostgresRepository, error) {
+	return &PostgresRepository{sqlRepository{db: db, dialect: dialect.Postgres}}, nil
+}
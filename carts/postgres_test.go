@@ -0,0 +1,99 @@
+package carts
+
+import (
+	"os"
+	"testing"
+
+	"github.com/kvalv/shoplist/migrations"
+	"github.com/kvalv/shoplist/pgtest"
+)
+
+func TestMain(m *testing.M) { os.Exit(pgtest.Main(m)) }
+
+func TestPostgresAddAndTick(t *testing.T) {
+	repo := newPostgresMock(t, "alice", "bob")
+
+	cart := New().WithName("groceries")
+	item := cart.Add("milk", "alice")
+	if err := repo.Save(cart); err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+
+	item.Toggle("bob")
+	if err := repo.Save(cart); err != nil {
+		t.Fatalf("failed to tick: %v", err)
+	}
+
+	expectItem(t, repo, cart.ID, item.ID, func(item *Item) {
+		if !item.Checked {
+			t.Errorf("Expected item to be checked, but it was not")
+		}
+		if item.UpdatedBy != "bob" {
+			t.Errorf("Expected item to be updated by 'bob', but got '%s'", item.UpdatedBy)
+		}
+	})
+
+	latest, err := repo.Latest()
+	if err != nil {
+		t.Fatalf("Latest() error: %v", err)
+	}
+	if latest.ID != cart.ID || latest.Name != "groceries" {
+		t.Fatalf("Latest() = %s %q, want %s %q", latest.ID, latest.Name, cart.ID, "groceries")
+	}
+}
+
+func TestPostgresCollaborator(t *testing.T) {
+	repo := newPostgresMock(t, "user", "newuser")
+
+	t.Run("with collaborator due to trigger", func(t *testing.T) {
+		cart := New().WithCreator("user")
+		if err := repo.Save(cart); err != nil {
+			t.Fatalf("Failed to save cart: %s", err)
+		}
+		expectCollaborator(t, repo, cart.ID, "user", true)
+
+		// saving again goes through the update path and must not add a
+		// second row.
+		if err := repo.Save(cart); err != nil {
+			t.Fatalf("Failed to save cart: %s", err)
+		}
+		if got, _ := repo.Collaborators(cart.ID); len(got) != 1 {
+			t.Fatalf("Expected 1 collaborator, got %d", len(got))
+		}
+	})
+
+	t.Run("add collaborator", func(t *testing.T) {
+		cart := New()
+		if err := repo.Save(cart); err != nil {
+			t.Fatalf("Failed to save cart: %s", err)
+		}
+		expectCollaborator(t, repo, cart.ID, "newuser", false)
+
+		if err := repo.AddCollaborators(cart.ID, "alice", "newuser"); err != nil {
+			t.Fatalf("AddCollaborator() error: %v", err)
+		}
+		expectCollaborator(t, repo, cart.ID, "newuser", true)
+	})
+}
+
+func newPostgresMock(t *testing.T, userIDs ...string) *PostgresRepository {
+	db := pgtest.Open(t)
+	if err := migrations.MigratePostgres(db); err != nil {
+		t.Fatalf("failed to migrate: %s", err)
+	}
+	// running it twice must be a no-op
+	if err := migrations.MigratePostgres(db); err != nil {
+		t.Fatalf("failed to migrate twice: %s", err)
+	}
+	for _, userID := range userIDs {
+		if _, err := db.Exec(`INSERT INTO users (user_id, name, email) VALUES ($1, $2, $3)`, userID, userID, userID+"@example.com"); err != nil {
+			t.Fatalf("failed to insert user: %s", err)
+		}
+	}
+
+	repo, err := NewPostgresRepository(db)
+	if err != nil {
+		t.Fatalf("failed to create repository: %s", err)
+	}
+	return repo
+}
@@ -0,0 +1,43 @@
+package carts
+
+import (
+	"github.com/kvalv/shoplist/events"
+	"github.com/kvalv/shoplist/stores"
+)
+
+// Repository persists carts, their items and collaborators. It is
+// implemented for SQLite and Postgres, see [NewRepository] and
+// [NewPostgresRepository].
+type Repository interface {
+	// Save stores the cart, its new items, and the items checked or
+	// unchecked since it was loaded. The other items are left alone, and so
+	// are the candidates and enrichment of existing ones, as the worker may
+	// have moved them along. The events are staged in the same transaction,
+	// see [events.Stage], with a [events.CollaboratorAdded] for the creator
+	// of a new cart.
+	Save(cart *Cart, evs ...events.Event) error
+	// SaveItem stores one item of a cart, its enrichment included (removed
+	// if nil), leaving the rest of the cart alone, so that concurrent changes
+	// to other items are not overwritten.
+	SaveItem(cartID string, item *Item, evs ...events.Event) error
+	// RemoveItem deletes an item of a cart along with its candidates and
+	// enrichment, staging the events with it.
+	RemoveItem(cartID, itemID string, evs ...events.Event) error
+	Latest() (*Cart, error)
+	List(n int) ([]*Cart, error)
+	Cart(ID string) (*Cart, error)
+	// ShopPreference returns the shop the user last picked for the store,
+	// or "" if none.
+	ShopPreference(userID string, store stores.Store) (string, error)
+	SetShopPreference(userID string, store stores.Store, shopID string) error
+	// AreaOrder returns the order to walk the areas of the shop in, see
+	// [Route]. Empty if none was set.
+	AreaOrder(store stores.Store, shopID string) ([]string, error)
+	// SetAreaOrder replaces the area order of the shop, staging the events
+	// with it.
+	SetAreaOrder(store stores.Store, shopID string, areas []string, evs ...events.Event) error
+	Collaborators(cartID string) ([]string, error)
+	// AddCollaborators adds the users to the cart on behalf of actor, staging
+	// a [events.CollaboratorAdded] for each that wasn't one already.
+	AddCollaborators(cartID, actor string, userIDs ...string) error
+}
@@ -0,0 +1,88 @@
+package carts
+
+import (
+	"cmp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/kvalv/shoplist/stores"
+)
+
+// Route orders the items for walking through a shop of the store: by the
+// area of the chosen candidate, in the given order, and by shelf number
+// within an area. Areas not in the order come after, by name. Items without
+// a location go after those, and checked items last, each as they were.
+func Route(items []*Item, store stores.Store, order []string) []*Item {
+	areas := Areas(items, store, order)
+	rank := func(item *Item) (int, stores.Location) {
+		if item.Checked {
+			return len(areas) + 1, stores.Location{}
+		}
+		loc, ok := location(item, store)
+		if !ok {
+			return len(areas), loc
+		}
+		return slices.Index(areas, loc.Area), loc
+	}
+
+	route := slices.Clone(items)
+	slices.SortStableFunc(route, func(a, b *Item) int {
+		ra, la := rank(a)
+		rb, lb := rank(b)
+		if ra != rb || ra >= len(areas) {
+			return cmp.Compare(ra, rb)
+		}
+		return compareShelves(la.Shelf, lb.Shelf)
+	})
+	return route
+}
+
+// Areas returns the areas of the unchecked items in the order Route walks
+// them: those in the order first, then the rest by name.
+func Areas(items []*Item, store stores.Store, order []string) []string {
+	var rest []string
+	for _, item := range items {
+		loc, ok := location(item, store)
+		if item.Checked || !ok || slices.Contains(order, loc.Area) || slices.Contains(rest, loc.Area) {
+			continue
+		}
+		rest = append(rest, loc.Area)
+	}
+	slices.Sort(rest)
+	return append(slices.Clone(order), rest...)
+}
+
+// location returns the primary location of the chosen candidate of the item.
+func location(item *Item, store stores.Store) (stores.Location, bool) {
+	sel := item.SearchIn(store).Selected()
+	if sel == nil || len(sel.Locations) == 0 {
+		return stores.Location{}, false
+	}
+	return sel.Locations[0], true
+}
+
+// compareShelves compares shelves by their number, so that "9" comes before
+// "10", and by name if they have none.
+func compareShelves(a, b string) int {
+	na, errA := strconv.Atoi(leadingDigits(a))
+	nb, errB := strconv.Atoi(leadingDigits(b))
+	switch {
+	case errA == nil && errB == nil && na != nb:
+		return cmp.Compare(na, nb)
+	case errA == nil && errB != nil:
+		return -1
+	case errA != nil && errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func leadingDigits(s string) string {
+	s = strings.TrimSpace(s)
+	end := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if end < 0 {
+		return s
+	}
+	return s[:end]
+}
@@ -0,0 +1,71 @@
+package carts
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/kvalv/shoplist/stores"
+)
+
+func TestRoute(t *testing.T) {
+	at := func(text, area, shelf string) *Item {
+		chosen := 0
+		return &Item{ID: text, Text: text, Search: &Search{
+			Store:      stores.ClasOhlson,
+			Candidates: []stores.Candidate{{Locations: []stores.Location{{Area: area, Shelf: shelf}}}},
+			Chosen:     &chosen,
+		}}
+	}
+	items := []*Item{
+		{ID: "batteries", Text: "batteries"},
+		at("tape", "Verktøy", "12"),
+		at("rake", "Hage", "4"),
+		at("screws", "Verktøy", "9"),
+		at("cable", "Elektro", "2B"),
+		{ID: "done", Checked: true},
+		at("hose", "Hage", "10"),
+		at("glue", "Verktøy", "-"),
+	}
+
+	cases := []struct {
+		name  string
+		order []string
+		want  []string
+		areas []string
+	}{
+		{
+			name:  "by name",
+			want:  []string{"cable", "rake", "hose", "screws", "tape", "glue", "batteries", "done"},
+			areas: []string{"Elektro", "Hage", "Verktøy"},
+		},
+		{
+			name:  "custom order first",
+			order: []string{"Verktøy", "Kjøkken"},
+			want:  []string{"screws", "tape", "glue", "cable", "rake", "hose", "batteries", "done"},
+			areas: []string{"Verktøy", "Kjøkken", "Elektro", "Hage"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, item := range Route(items, stores.ClasOhlson, tc.order) {
+				got = append(got, item.ID)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("Route() = %v, want %v", got, tc.want)
+			}
+			if areas := Areas(items, stores.ClasOhlson, tc.order); !slices.Equal(areas, tc.areas) {
+				t.Errorf("Areas() = %v, want %v", areas, tc.areas)
+			}
+		})
+	}
+
+	// candidates from another store have no say
+	var got []string
+	for _, item := range Route(items, stores.Kiwi, nil) {
+		got = append(got, item.ID)
+	}
+	if want := []string{"batteries", "tape", "rake", "screws", "cable", "hose", "glue", "done"}; !slices.Equal(got, want) {
+		t.Errorf("Route(Kiwi) = %v, want %v", got, want)
+	}
+}
@@ -2,19 +2,29 @@ package carts
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
-	"github.com/kvalv/shoplist/stores/clasohlson"
+	"github.com/kvalv/shoplist/dialect"
+	"github.com/kvalv/shoplist/events"
+	"github.com/kvalv/shoplist/stores"
 	gonanoid "github.com/matoous/go-nanoid/v2"
 )
 
+// sqlRepository holds the queries shared by the SQLite and Postgres
+// repositories. Queries use '?' placeholders and go through [dialect.Dialect.Rebind].
+type sqlRepository struct {
+	db      *sql.DB
+	dialect dialect.Dialect
+}
+
 type SqliteRepository struct {
-	db *sql.DB
+	sqlRepository
 }
 
 func NewRepository(db *sql.DB) (*SqliteRepository, error) {
-	return &SqliteRepository{db: db}, nil
+	return &SqliteRepository{sqlRepository{db: db, dialect: dialect.SQLite}}, nil
 }
 
 func New() *Cart {
@@ -24,78 +34,281 @@ func New() *Cart {
 	}
 }
 
-func (r *SqliteRepository) Save(cart *Cart) error {
-	_, err := r.db.Exec(
-		`INSERT INTO carts (id, name, created_at, created_by, target_store, inactive) VALUES (?, ?, ?, ?, ?, ?)
-		 ON CONFLICT(id) DO UPDATE SET name = excluded.name, target_store = excluded.target_store, inactive = excluded.inactive`,
+func (r *sqlRepository) Save(cart *Cart, evs ...events.Event) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		r.dialect.Rebind(`INSERT INTO carts (id, name, created_at, created_by, target_store, inactive) VALUES (?, ?, ?, ?, ?, ?)
+		 ON CONFLICT(id) DO NOTHING`),
 		cart.ID, cart.Name, cart.CreatedAt, cart.CreatedBy, cart.TargetStore, cart.Inactive,
 	)
-
 	if err != nil {
 		return fmt.Errorf("save: %w", err)
 	}
+	created, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("save: %w", err)
+	}
+	if created == 0 {
+		_, err = tx.Exec(
+			r.dialect.Rebind(`UPDATE carts SET name = ?, target_store = ?, inactive = ? WHERE id = ?`),
+			cart.Name, cart.TargetStore, cart.Inactive, cart.ID,
+		)
+		if err != nil {
+			return fmt.Errorf("save: %w", err)
+		}
+	} else if cart.CreatedBy != nil {
+		// the ensure_collaborator trigger made the creator a collaborator
+		evs = append(evs, events.CollaboratorAdded{
+			CartID: cart.ID,
+			UserID: *cart.CreatedBy,
+			Actor:  *cart.CreatedBy,
+			At:     cart.CreatedAt,
+		})
+	}
+	if err := r.saveShop(tx, cart); err != nil {
+		return fmt.Errorf("save: %w", err)
+	}
 
 	for _, item := range cart.Items {
-		if err := r.saveItem(cart.ID, item); err != nil {
+		added, err := r.addItem(tx, cart.ID, item)
+		if err != nil {
 			return fmt.Errorf("items.save: %w", err)
 		}
+		switch {
+		case added:
+			if err := r.saveSearch(tx, item); err != nil {
+				return fmt.Errorf("items.save: %w", err)
+			}
+			if err := r.saveEnrichment(tx, item, false); err != nil {
+				return fmt.Errorf("items.save: %w", err)
+			}
+		case item.changed:
+			if err := r.saveItem(tx, cart.ID, item); err != nil {
+				return fmt.Errorf("items.save: %w", err)
+			}
+		}
+	}
+	for _, ev := range evs {
+		if _, err := events.Stage(tx, r.dialect, ev); err != nil {
+			return fmt.Errorf("events.stage: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, item := range cart.Items {
+		item.changed = false
 	}
 	return nil
 }
 
-func (r *SqliteRepository) saveItem(cartID string, item *Item) error {
+func (r *sqlRepository) SaveItem(cartID string, item *Item, evs ...events.Event) error {
 	tx, err := r.db.Begin()
 	if err != nil {
-		return err
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := r.saveItem(tx, cartID, item); err != nil {
+		return fmt.Errorf("items.save: %w", err)
+	}
+	if err := r.saveSearch(tx, item); err != nil {
+		return fmt.Errorf("items.save: %w", err)
+	}
+	if err := r.saveEnrichment(tx, item, true); err != nil {
+		return fmt.Errorf("items.save: %w", err)
+	}
+	for _, ev := range evs {
+		if _, err := events.Stage(tx, r.dialect, ev); err != nil {
+			return fmt.Errorf("events.stage: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// addItem stores the item if it's new, and tells whether it was.
+func (r *sqlRepository) RemoveItem(cartID, itemID string, evs ...events.Event) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
 	}
 	defer tx.Rollback()
 
-	var chosen *int
-	if item.Clas != nil {
-		chosen = item.Clas.Chosen
+	// foreign keys are not enforced on SQLite, so the cascade is spelled out
+	for _, query := range []string{
+		`DELETE FROM candidate_locations WHERE item_id = ?`,
+		`DELETE FROM candidate_stock WHERE item_id = ?`,
+		`DELETE FROM candidate_unit_prices WHERE item_id = ?`,
+		`DELETE FROM candidates WHERE item_id = ?`,
+		`DELETE FROM enrichment_jobs WHERE item_id = ?`,
+	} {
+		if _, err := tx.Exec(r.dialect.Rebind(query), itemID); err != nil {
+			return fmt.Errorf("items.remove: %w", err)
+		}
+	}
+	res, err := tx.Exec(r.dialect.Rebind(`DELETE FROM items WHERE id = ? AND cart_id = ?`), itemID, cartID)
+	if err != nil {
+		return fmt.Errorf("items.remove: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("items.remove: %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("items.remove: no item %q in cart %q", itemID, cartID)
+	}
+	for _, ev := range evs {
+		if _, err := events.Stage(tx, r.dialect, ev); err != nil {
+			return fmt.Errorf("events.stage: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *sqlRepository) addItem(tx *sql.Tx, cartID string, item *Item) (bool, error) {
+	res, err := tx.Exec(
+		r.dialect.Rebind(`INSERT INTO items (id, cart_id, text, checked, created_at, updated_at, created_by, updated_by) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		 ON CONFLICT(id) DO NOTHING`),
+		item.ID, cartID, item.Text, item.Checked, item.CreatedAt, item.UpdatedAt, item.CreatedBy, item.UpdatedBy,
+	)
+	if err != nil {
+		return false, fmt.Errorf("addItem: %w", err)
 	}
-	_, err = tx.Exec(
-		`INSERT INTO items (id, cart_id, text, checked, created_at, updated_at, created_by, updated_by, clas_chosen) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-		 ON CONFLICT(id) DO UPDATE SET checked = excluded.checked, updated_at = excluded.updated_at, updated_by = excluded.updated_by, clas_chosen = excluded.clas_chosen`,
-		item.ID, cartID, item.Text, item.Checked, item.CreatedAt, item.UpdatedAt, item.CreatedBy, item.UpdatedBy, chosen,
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (r *sqlRepository) saveItem(tx *sql.Tx, cartID string, item *Item) error {
+	_, err := tx.Exec(
+		r.dialect.Rebind(`INSERT INTO items (id, cart_id, text, checked, created_at, updated_at, created_by, updated_by) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		 ON CONFLICT(id) DO UPDATE SET checked = excluded.checked, updated_at = excluded.updated_at, updated_by = excluded.updated_by`),
+		item.ID, cartID, item.Text, item.Checked, item.CreatedAt, item.UpdatedAt, item.CreatedBy, item.UpdatedBy,
 	)
 
 	if err != nil {
 		return fmt.Errorf("saveItem: %w", err)
 	}
+	return nil
+}
 
-	if item.Clas != nil && len(item.Clas.Candidates) > 0 {
-		tx.Exec(`DELETE FROM clas_candidates WHERE item_id = ?`, item.ID)
-		for i, c := range item.Clas.Candidates {
-			var area, shelf *string
-			if len(c.Locations) > 0 {
-				area = &c.Locations[0].Area
-				shelf = &c.Locations[0].Shelf
+// saveSearch replaces the candidates of the item, unless it has none.
+func (r *sqlRepository) saveSearch(tx *sql.Tx, item *Item) error {
+	if s := item.Search; s != nil && len(s.Candidates) > 0 {
+		// what belongs to the candidates first, then the candidates
+		for _, table := range []string{"candidate_locations", "candidate_stock", "candidate_unit_prices", "candidates"} {
+			if _, err := tx.Exec(r.dialect.Rebind(`DELETE FROM `+table+` WHERE item_id = ?`), item.ID); err != nil {
+				return fmt.Errorf("%s: %w", table, err)
 			}
+		}
+		for i, c := range s.Candidates {
+			chosen := s.Chosen != nil && *s.Chosen == i
 			_, err := tx.Exec(
-				`INSERT INTO clas_candidates (item_id, idx, gtm_id, name, price, url, picture, reviews, stock, area, shelf)
-				 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-				item.ID, i, c.ID, c.Name, c.Price, c.URL, c.Picture, c.Reviews, c.Stock, area, shelf,
+				r.dialect.Rebind(`INSERT INTO candidates (item_id, idx, store, product_id, name, price, url, picture, reviews, stock, chosen)
+				 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+				item.ID, i, s.Store, c.ID, c.Name, c.Price, c.URL, c.Picture, c.Reviews, c.Stock, chosen,
 			)
 			if err != nil {
 				return err
 			}
+			if c.Unit != "" {
+				_, err := tx.Exec(
+					r.dialect.Rebind(`INSERT INTO candidate_unit_prices (item_id, idx, unit_price, unit) VALUES (?, ?, ?, ?)`),
+					item.ID, i, c.UnitPrice, c.Unit,
+				)
+				if err != nil {
+					return err
+				}
+			}
+			// the order of locations is kept, so the primary one stays first
+			for pos, loc := range c.Locations {
+				_, err := tx.Exec(
+					r.dialect.Rebind(`INSERT INTO candidate_locations (item_id, idx, pos, area, shelf) VALUES (?, ?, ?, ?, ?)`),
+					item.ID, i, pos, loc.Area, loc.Shelf,
+				)
+				if err != nil {
+					return err
+				}
+			}
+			for pos, shop := range c.Elsewhere {
+				_, err := tx.Exec(
+					r.dialect.Rebind(`INSERT INTO candidate_stock (item_id, idx, pos, shop_id, name, stock) VALUES (?, ?, ?, ?, ?, ?)`),
+					item.ID, i, pos, shop.ShopID, shop.Name, shop.Stock,
+				)
+				if err != nil {
+					return err
+				}
+			}
 		}
 	}
-	return tx.Commit()
+	return nil
+}
+
+// saveEnrichment stores the enrichment of the item. An existing one is only
+// replaced, or removed if the item has none, when overwrite is set.
+func (r *sqlRepository) saveEnrichment(tx *sql.Tx, item *Item, overwrite bool) error {
+	e := item.Enrichment
+	if e == nil && overwrite {
+		if _, err := tx.Exec(r.dialect.Rebind(`DELETE FROM enrichment_jobs WHERE item_id = ?`), item.ID); err != nil {
+			return fmt.Errorf("enrichment_jobs: %w", err)
+		}
+	}
+	if e == nil {
+		return nil
+	}
+	conflict := `DO NOTHING`
+	if overwrite {
+		conflict = `DO UPDATE SET state = excluded.state, attempts = excluded.attempts, error = excluded.error, updated_at = excluded.updated_at`
+	}
+	_, err := tx.Exec(
+		r.dialect.Rebind(`INSERT INTO enrichment_jobs (item_id, state, attempts, error, updated_at) VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT(item_id) `+conflict),
+		item.ID, e.State, e.Attempts, e.Error, e.UpdatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("enrichment_jobs: %w", err)
+	}
+	return nil
 }
 
-func (r *SqliteRepository) Latest() (*Cart, error) {
-	row := r.db.QueryRow(`SELECT id, name, created_at, target_store, inactive FROM carts ORDER BY created_at DESC LIMIT 1`)
+func (r *sqlRepository) saveShop(tx *sql.Tx, cart *Cart) error {
+	if cart.ShopID == "" {
+		_, err := tx.Exec(r.dialect.Rebind(`DELETE FROM cart_shops WHERE cart_id = ?`), cart.ID)
+		return err
+	}
+	_, err := tx.Exec(
+		r.dialect.Rebind(`INSERT INTO cart_shops (cart_id, shop_id) VALUES (?, ?)
+		 ON CONFLICT(cart_id) DO UPDATE SET shop_id = excluded.shop_id`),
+		cart.ID, cart.ShopID,
+	)
+	return err
+}
+
+// selectCarts is what scanCart reads, to be followed by WHERE, ORDER BY etc.
+const selectCarts = `SELECT c.id, c.name, c.created_at, c.created_by, c.target_store, c.inactive, coalesce(s.shop_id, '')
+	FROM carts c LEFT JOIN cart_shops s ON s.cart_id = c.id `
+
+func scanCart(row interface{ Scan(...any) error }) (*Cart, error) {
 	cart := &Cart{}
-	if err := row.Scan(&cart.ID, &cart.Name, &cart.CreatedAt, &cart.TargetStore, &cart.Inactive); err != nil {
+	err := row.Scan(&cart.ID, &cart.Name, &cart.CreatedAt, &cart.CreatedBy, &cart.TargetStore, &cart.Inactive, &cart.ShopID)
+	if err != nil {
+		return nil, err
+	}
+	return cart, nil
+}
+
+func (r *sqlRepository) Latest() (*Cart, error) {
+	cart, err := scanCart(r.db.QueryRow(r.dialect.Rebind(selectCarts + `ORDER BY c.created_at DESC LIMIT 1`)))
+	if err != nil {
 		return nil, err
 	}
 	return r.loadCartItems(cart)
 }
 
-func (r *SqliteRepository) List(n int) ([]*Cart, error) {
-	rows, err := r.db.Query(`SELECT id, name, created_at, target_store, inactive FROM carts ORDER BY created_at DESC LIMIT ?`, n)
+func (r *sqlRepository) List(n int) ([]*Cart, error) {
+	rows, err := r.db.Query(r.dialect.Rebind(selectCarts+`ORDER BY c.created_at DESC LIMIT ?`), n)
 	if err != nil {
 		return nil, err
 	}
@@ -103,8 +316,8 @@ func (r *SqliteRepository) List(n int) ([]*Cart, error) {
 
 	var carts []*Cart
 	for rows.Next() {
-		cart := &Cart{}
-		if err := rows.Scan(&cart.ID, &cart.Name, &cart.CreatedAt, &cart.TargetStore, &cart.Inactive); err != nil {
+		cart, err := scanCart(rows)
+		if err != nil {
 			return nil, err
 		}
 		carts = append(carts, cart)
@@ -120,17 +333,16 @@ func (r *SqliteRepository) List(n int) ([]*Cart, error) {
 	return carts, nil
 }
 
-func (r *SqliteRepository) Cart(ID string) (*Cart, error) {
-	row := r.db.QueryRow(`SELECT id, name, created_at, target_store, inactive FROM carts WHERE id = ?`, ID)
-	cart := &Cart{}
-	if err := row.Scan(&cart.ID, &cart.Name, &cart.CreatedAt, &cart.TargetStore, &cart.Inactive); err != nil {
+func (r *sqlRepository) Cart(ID string) (*Cart, error) {
+	cart, err := scanCart(r.db.QueryRow(r.dialect.Rebind(selectCarts+`WHERE c.id = ?`), ID))
+	if err != nil {
 		return nil, err
 	}
 	return r.loadCartItems(cart)
 }
 
-func (r *SqliteRepository) loadCartItems(cart *Cart) (*Cart, error) {
-	rows, err := r.db.Query(`SELECT id, text, checked, created_at, updated_at, clas_chosen, created_by, updated_by FROM items WHERE cart_id = ? ORDER BY checked ASC, updated_at DESC`, cart.ID)
+func (r *sqlRepository) loadCartItems(cart *Cart) (*Cart, error) {
+	rows, err := r.db.Query(r.dialect.Rebind(`SELECT id, text, checked, created_at, updated_at, created_by, updated_by FROM items WHERE cart_id = ? ORDER BY checked ASC, updated_at DESC`), cart.ID)
 	if err != nil {
 		return nil, err
 	}
@@ -138,9 +350,8 @@ func (r *SqliteRepository) loadCartItems(cart *Cart) (*Cart, error) {
 
 	for rows.Next() {
 		item := &Item{}
-		var chosen *int
 		var updatedAt *time.Time
-		if err := rows.Scan(&item.ID, &item.Text, &item.Checked, &item.CreatedAt, &updatedAt, &chosen, &item.CreatedBy, &item.UpdatedBy); err != nil {
+		if err := rows.Scan(&item.ID, &item.Text, &item.Checked, &item.CreatedAt, &updatedAt, &item.CreatedBy, &item.UpdatedBy); err != nil {
 			return nil, err
 		}
 		if updatedAt != nil {
@@ -148,24 +359,39 @@ func (r *SqliteRepository) loadCartItems(cart *Cart) (*Cart, error) {
 		} else {
 			item.UpdatedAt = item.CreatedAt
 		}
-		if chosen != nil {
-			item.Clas = &ClasSearch{Chosen: chosen}
-		}
 		cart.Items = append(cart.Items, item)
 	}
 
 	for _, item := range cart.Items {
-		if err := r.loadClasCandidates(item); err != nil {
+		if err := r.loadCandidates(item); err != nil {
+			return nil, err
+		}
+		if err := r.loadEnrichment(item); err != nil {
 			return nil, err
 		}
 	}
 	return cart, nil
 }
 
-func (r *SqliteRepository) loadClasCandidates(item *Item) error {
+func (r *sqlRepository) loadEnrichment(item *Item) error {
+	e := &Enrichment{}
+	err := r.db.QueryRow(
+		r.dialect.Rebind(`SELECT state, attempts, error, updated_at FROM enrichment_jobs WHERE item_id = ?`), item.ID,
+	).Scan(&e.State, &e.Attempts, &e.Error, &e.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	item.Enrichment = e
+	return nil
+}
+
+func (r *sqlRepository) loadCandidates(item *Item) error {
 	rows, err := r.db.Query(
-		`SELECT gtm_id, name, price, url, picture, reviews, stock, area, shelf
-		 FROM clas_candidates WHERE item_id = ? ORDER BY idx`, item.ID,
+		r.dialect.Rebind(`SELECT store, product_id, name, price, url, picture, reviews, stock, chosen
+		 FROM candidates WHERE item_id = ? ORDER BY idx`), item.ID,
 	)
 	if err != nil {
 		return err
@@ -173,24 +399,188 @@ func (r *SqliteRepository) loadClasCandidates(item *Item) error {
 	defer rows.Close()
 
 	for rows.Next() {
-		var c clasohlson.Item
-		var area, shelf *string
-		if err := rows.Scan(&c.ID, &c.Name, &c.Price, &c.URL, &c.Picture, &c.Reviews, &c.Stock, &area, &shelf); err != nil {
+		var (
+			c      stores.Candidate
+			store  stores.Store
+			chosen bool
+		)
+		if err := rows.Scan(&store, &c.ID, &c.Name, &c.Price, &c.URL, &c.Picture, &c.Reviews, &c.Stock, &chosen); err != nil {
 			return err
 		}
-		if area != nil && shelf != nil {
-			c.Locations = []clasohlson.ShelfLocation{{Area: *area, Shelf: *shelf}}
+		if item.Search == nil {
+			item.Search = &Search{Store: store}
 		}
-		if item.Clas == nil {
-			item.Clas = &ClasSearch{}
+		if chosen {
+			idx := len(item.Search.Candidates)
+			item.Search.Chosen = &idx
 		}
-		item.Clas.Candidates = append(item.Clas.Candidates, c)
+		item.Search.Candidates = append(item.Search.Candidates, c)
 	}
-	return nil
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if item.Search == nil {
+		return nil
+	}
+	if err := r.loadLocations(item); err != nil {
+		return err
+	}
+	if err := r.loadElsewhere(item); err != nil {
+		return err
+	}
+	return r.loadUnitPrices(item)
 }
 
-func (r *SqliteRepository) Collaborators(cartID string) ([]string, error) {
-	rows, err := r.db.Query(`select user_id from collaborators where cart_id = ?`, cartID)
+func (r *sqlRepository) loadLocations(item *Item) error {
+	rows, err := r.db.Query(
+		r.dialect.Rebind(`SELECT idx, area, shelf FROM candidate_locations WHERE item_id = ? ORDER BY idx, pos`), item.ID,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			idx int
+			loc stores.Location
+		)
+		if err := rows.Scan(&idx, &loc.Area, &loc.Shelf); err != nil {
+			return err
+		}
+		if idx < 0 || idx >= len(item.Search.Candidates) {
+			continue
+		}
+		c := &item.Search.Candidates[idx]
+		c.Locations = append(c.Locations, loc)
+	}
+	return rows.Err()
+}
+
+func (r *sqlRepository) loadElsewhere(item *Item) error {
+	rows, err := r.db.Query(
+		r.dialect.Rebind(`SELECT idx, shop_id, name, stock FROM candidate_stock WHERE item_id = ? ORDER BY idx, pos`), item.ID,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			idx  int
+			shop stores.ShopStock
+		)
+		if err := rows.Scan(&idx, &shop.ShopID, &shop.Name, &shop.Stock); err != nil {
+			return err
+		}
+		if idx < 0 || idx >= len(item.Search.Candidates) {
+			continue
+		}
+		c := &item.Search.Candidates[idx]
+		c.Elsewhere = append(c.Elsewhere, shop)
+	}
+	return rows.Err()
+}
+
+func (r *sqlRepository) loadUnitPrices(item *Item) error {
+	rows, err := r.db.Query(
+		r.dialect.Rebind(`SELECT idx, unit_price, unit FROM candidate_unit_prices WHERE item_id = ?`), item.ID,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			idx       int
+			unitPrice float64
+			unit      string
+		)
+		if err := rows.Scan(&idx, &unitPrice, &unit); err != nil {
+			return err
+		}
+		if idx < 0 || idx >= len(item.Search.Candidates) {
+			continue
+		}
+		c := &item.Search.Candidates[idx]
+		c.UnitPrice, c.Unit = unitPrice, unit
+	}
+	return rows.Err()
+}
+
+func (r *sqlRepository) ShopPreference(userID string, store stores.Store) (string, error) {
+	var shopID string
+	err := r.db.QueryRow(
+		r.dialect.Rebind(`SELECT shop_id FROM user_shops WHERE user_id = ? AND store = ?`),
+		userID, store,
+	).Scan(&shopID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return shopID, err
+}
+
+func (r *sqlRepository) SetShopPreference(userID string, store stores.Store, shopID string) error {
+	_, err := r.db.Exec(
+		r.dialect.Rebind(`INSERT INTO user_shops (user_id, store, shop_id) VALUES (?, ?, ?)
+		 ON CONFLICT(user_id, store) DO UPDATE SET shop_id = excluded.shop_id`),
+		userID, store, shopID,
+	)
+	return err
+}
+
+func (r *sqlRepository) AreaOrder(store stores.Store, shopID string) ([]string, error) {
+	rows, err := r.db.Query(
+		r.dialect.Rebind(`SELECT area FROM area_orders WHERE store = ? AND shop_id = ? ORDER BY pos`),
+		store, shopID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var areas []string
+	for rows.Next() {
+		var area string
+		if err := rows.Scan(&area); err != nil {
+			return nil, err
+		}
+		areas = append(areas, area)
+	}
+	return areas, rows.Err()
+}
+
+func (r *sqlRepository) SetAreaOrder(store stores.Store, shopID string, areas []string, evs ...events.Event) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(r.dialect.Rebind(`DELETE FROM area_orders WHERE store = ? AND shop_id = ?`), store, shopID); err != nil {
+		return fmt.Errorf("area_orders: %w", err)
+	}
+	for pos, area := range areas {
+		_, err := tx.Exec(
+			r.dialect.Rebind(`INSERT INTO area_orders (store, shop_id, pos, area) VALUES (?, ?, ?, ?)`),
+			store, shopID, pos, area,
+		)
+		if err != nil {
+			return fmt.Errorf("area_orders: %w", err)
+		}
+	}
+	for _, ev := range evs {
+		if _, err := events.Stage(tx, r.dialect, ev); err != nil {
+			return fmt.Errorf("events.stage: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *sqlRepository) Collaborators(cartID string) ([]string, error) {
+	rows, err := r.db.Query(r.dialect.Rebind(`select user_id from collaborators where cart_id = ?`), cartID)
 	if err != nil {
 		return nil, err
 	}
@@ -207,14 +597,32 @@ func (r *SqliteRepository) Collaborators(cartID string) ([]string, error) {
 	return users, nil
 }
 
-func (r *SqliteRepository) AddCollaborators(cartID string, userIDs ...string) error {
+func (r *sqlRepository) AddCollaborators(cartID, actor string, userIDs ...string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
 	for _, userID := range userIDs {
-		if _, err := r.db.Exec(
-			`INSERT INTO collaborators (cart_id, user_id) VALUES (?, ?) ON CONFLICT DO NOTHING`,
-			cartID, userID,
-		); err != nil {
-			return err
+		res, err := tx.Exec(
+			// the table has no key to conflict on
+			r.dialect.Rebind(`INSERT INTO collaborators (cart_id, user_id) SELECT ?, ?
+			 WHERE NOT EXISTS (SELECT 1 FROM collaborators WHERE cart_id = ? AND user_id = ?)`),
+			cartID, userID, cartID, userID,
+		)
+		if err != nil {
+			return fmt.Errorf("collaborators: %w", err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return fmt.Errorf("collaborators: %w", err)
+		} else if n == 0 {
+			continue // already one
+		}
+		added := events.CollaboratorAdded{CartID: cartID, UserID: userID, Actor: actor, At: time.Now()}
+		if _, err := events.Stage(tx, r.dialect, added); err != nil {
+			return fmt.Errorf("events.stage: %w", err)
 		}
 	}
-	return nil
+	return tx.Commit()
 }
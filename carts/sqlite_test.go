@@ -2,9 +2,13 @@ package carts
 
 import (
 	"database/sql"
+	"slices"
 	"testing"
+	"time"
 
+	"github.com/kvalv/shoplist/events"
 	"github.com/kvalv/shoplist/migrations"
+	"github.com/kvalv/shoplist/stores"
 	_ "modernc.org/sqlite"
 )
 
@@ -13,7 +17,7 @@ func TestSqliteBasic(t *testing.T) {
 
 	// Create a cart
 	cart := New()
-	if err := repo.Save(New()); err != nil {
+	if err := repo.Save(cart); err != nil {
 		t.Fatalf("Failed to save cart: %s", err)
 	}
 	t.Logf("Created cart: %+v", cart)
@@ -62,7 +66,279 @@ func TestAddAndTick(t *testing.T) {
 	})
 }
 
-func expectItem(t *testing.T, repo *SqliteRepository, cartID string, itemID string, cb func(item *Item)) {
+func TestRemoveItem(t *testing.T) {
+	repo, db := NewMock()
+
+	cart := New()
+	milk := cart.Add("milk", "alice")
+	bread := cart.Add("bread", "alice")
+	milk.Search = &Search{Store: stores.ClasOhlson, Candidates: []stores.Candidate{{ID: "1", Name: "Melk", Locations: []stores.Location{{Area: "Kjøl", Shelf: "1"}}}}}
+	if err := repo.Save(cart); err != nil {
+		t.Fatalf("Save() error: %v", err)
+	}
+
+	removed := events.ItemRemoved{CartID: cart.ID, ItemID: milk.ID, Actor: "bob", At: time.Now()}
+	if err := repo.RemoveItem(cart.ID, milk.ID, removed); err != nil {
+		t.Fatalf("RemoveItem() error: %v", err)
+	}
+	got, err := repo.Cart(cart.ID)
+	if err != nil {
+		t.Fatalf("Cart() error: %v", err)
+	}
+	if len(got.Items) != 1 || got.Items[0].ID != bread.ID {
+		t.Errorf("items = %+v, want only the bread", got.Items)
+	}
+	var candidates int
+	if err := db.QueryRow(`SELECT count(*) FROM candidates WHERE item_id = ?`, milk.ID).Scan(&candidates); err != nil {
+		t.Fatalf("count candidates: %v", err)
+	}
+	if candidates != 0 {
+		t.Errorf("%d candidates left of the removed item", candidates)
+	}
+	history, err := events.NewSqlStore(db).History(cart.ID, 1)
+	if err != nil {
+		t.Fatalf("History() error: %v", err)
+	}
+	if len(history) != 1 || history[0].Type != "ItemRemoved" || history[0].Actor != "bob" {
+		t.Errorf("history = %+v, want the removal", history)
+	}
+
+	if err := repo.RemoveItem(cart.ID, milk.ID); err == nil {
+		t.Errorf("RemoveItem() of a removed item succeeded")
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	repo, _ := NewMock()
+
+	cart := New()
+	item := cart.Add("skopose", "alice")
+	chosen := 1
+	item.Search = &Search{
+		Store:  stores.ClasOhlson,
+		Chosen: &chosen,
+		Candidates: []stores.Candidate{
+			{ID: "1", Name: "Skopose XL", UnitPrice: 12.5, Unit: "stk"},
+			{ID: "2", Name: "Skopose", Locations: []stores.Location{
+				{Area: "Hjem", Shelf: "12"},
+				{Area: "Kampanje", Shelf: "3"},
+			}, Elsewhere: []stores.ShopStock{
+				{ShopID: "215", Name: "Bergen Storsenter", Stock: 12},
+				{ShopID: "300", Stock: 1},
+			}},
+		},
+	}
+	if err := repo.Save(cart); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+
+	expectItem(t, repo, cart.ID, item.ID, func(item *Item) {
+		if item.Search.Store != stores.ClasOhlson {
+			t.Errorf("Expected candidates from Clas Ohlson, got %v", item.Search.Store)
+		}
+		sel := item.Search.Selected()
+		if sel == nil || sel.ID != "2" {
+			t.Fatalf("Expected the second candidate to be selected, got %+v", sel)
+		}
+		want := []stores.Location{{Area: "Hjem", Shelf: "12"}, {Area: "Kampanje", Shelf: "3"}}
+		if !slices.Equal(sel.Locations, want) {
+			t.Errorf("Expected locations %+v, got %+v", want, sel.Locations)
+		}
+		if got := item.Search.Candidates[0].Locations; len(got) != 0 {
+			t.Errorf("Expected no locations for first candidate, got %+v", got)
+		}
+		if first := item.Search.Candidates[0]; first.UnitPrice != 12.5 || first.Unit != "stk" {
+			t.Errorf("Expected 12.5 per stk for first candidate, got %v per %q", first.UnitPrice, first.Unit)
+		}
+		if sel.Unit != "" {
+			t.Errorf("Expected no unit price for the selected candidate, got %q", sel.Unit)
+		}
+		elsewhere := []stores.ShopStock{{ShopID: "215", Name: "Bergen Storsenter", Stock: 12}, {ShopID: "300", Stock: 1}}
+		if !slices.Equal(sel.Elsewhere, elsewhere) {
+			t.Errorf("Expected stock elsewhere %+v, got %+v", elsewhere, sel.Elsewhere)
+		}
+	})
+
+	// saving again replaces, rather than duplicates, the locations
+	if err := repo.SaveItem(cart.ID, item); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+	expectItem(t, repo, cart.ID, item.ID, func(item *Item) {
+		if got := len(item.Search.Selected().Locations); got != 2 {
+			t.Errorf("Expected 2 locations after resave, got %d", got)
+		}
+		if got := len(item.Search.Selected().Elsewhere); got != 2 {
+			t.Errorf("Expected 2 shops elsewhere after resave, got %d", got)
+		}
+	})
+}
+
+// Candidates saved before any store could have them are moved over by the
+// migration.
+func TestClasCandidatesMigration(t *testing.T) {
+	repo, db := NewMock()
+
+	// a new database never has the legacy tables
+	var legacy int
+	if err := db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name LIKE 'clas\_%' ESCAPE '\' AND name != 'clas_cache'`).Scan(&legacy); err != nil {
+		t.Fatalf("failed to look for legacy tables: %v", err)
+	}
+	if legacy != 0 {
+		t.Fatalf("expected no legacy tables, found %d", legacy)
+	}
+
+	cart := New()
+	item := cart.Add("skopose", "alice")
+	if err := repo.Save(cart); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+	for _, q := range []string{
+		`CREATE TABLE clas_candidates(item_id text, idx integer, gtm_id text, name text, price real, url text, picture text, reviews integer, stock integer, area text, shelf text, PRIMARY KEY (item_id, idx))`,
+		`CREATE TABLE clas_locations(item_id text, idx integer, pos integer, area text, shelf text, PRIMARY KEY (item_id, idx, pos))`,
+		`INSERT INTO clas_candidates VALUES ('` + item.ID + `', 0, 'a', 'Skopose', 49.9, 'url', 'pic', 3, 7, NULL, NULL)`,
+		`INSERT INTO clas_candidates VALUES ('` + item.ID + `', 1, 'b', 'Skopose XL', 59.9, 'url', 'pic', 1, 0, 'Hjem', '12')`,
+		`UPDATE items SET clas_chosen = 1 WHERE id = '` + item.ID + `'`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("failed to set up legacy tables: %v", err)
+		}
+	}
+	if err := migrations.Migrate(db); err != nil {
+		t.Fatalf("Migrate() error: %v", err)
+	}
+
+	expectItem(t, repo, cart.ID, item.ID, func(item *Item) {
+		if item.Search == nil || len(item.Search.Candidates) != 2 || item.Search.Store != stores.ClasOhlson {
+			t.Fatalf("Expected 2 Clas Ohlson candidates, got %+v", item.Search)
+		}
+		sel := item.Search.Selected()
+		if sel == nil || sel.ID != "b" || len(sel.Locations) != 1 || sel.Locations[0].Shelf != "12" {
+			t.Errorf("Expected the chosen candidate with its location, got %+v", sel)
+		}
+	})
+}
+
+func TestEnrichment(t *testing.T) {
+	repo, _ := NewMock()
+
+	cart := New()
+	item := cart.Add("skopose", "alice")
+	other := cart.Add("melk", "alice")
+	item.Enrichment = &Enrichment{State: EnrichQueued, UpdatedAt: time.Now()}
+	if err := repo.Save(cart); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+	expectEnrichment(t, repo, cart.ID, item.ID, EnrichQueued)
+
+	// saving one item leaves the others as they are in the database
+	other.Toggle("bob")
+	item.Enrichment = &Enrichment{State: EnrichFailed, Attempts: 5, Error: "unavailable", UpdatedAt: time.Now()}
+	if err := repo.SaveItem(cart.ID, item); err != nil {
+		t.Fatalf("SaveItem() error: %v", err)
+	}
+	expectItem(t, repo, cart.ID, item.ID, func(item *Item) {
+		if e := item.Enrichment; e.Attempts != 5 || e.Error != "unavailable" {
+			t.Errorf("Expected the failure to be saved, got %+v", e)
+		}
+	})
+	expectItem(t, repo, cart.ID, other.ID, func(item *Item) {
+		if item.Checked {
+			t.Errorf("Expected the other item to be left alone")
+		}
+	})
+
+	// saving the cart doesn't overwrite what the worker has done since
+	item.Enrichment = &Enrichment{State: EnrichQueued, UpdatedAt: time.Now()}
+	if err := repo.Save(cart); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+	expectEnrichment(t, repo, cart.ID, item.ID, EnrichFailed)
+
+	item.Enrichment = nil
+	if err := repo.SaveItem(cart.ID, item); err != nil {
+		t.Fatalf("SaveItem() error: %v", err)
+	}
+	expectItem(t, repo, cart.ID, item.ID, func(item *Item) {
+		if item.Enrichment != nil {
+			t.Errorf("Expected the enrichment to be removed, got %+v", item.Enrichment)
+		}
+	})
+}
+
+// A command saving the cart it loaded before the worker saved an item must
+// not put the item back as it was.
+func TestSaveStaleSnapshot(t *testing.T) {
+	repo, _ := NewMock()
+
+	cart := New()
+	skopose := cart.Add("skopose", "alice")
+	melk := cart.Add("melk", "alice")
+	search := func(item *Item, stock int) *Search {
+		chosen := 0
+		return &Search{Store: stores.ClasOhlson, Chosen: &chosen, Candidates: []stores.Candidate{
+			{ID: item.Text, Name: item.Text, Stock: stock, Locations: []stores.Location{{Area: "Hjem", Shelf: "12"}}},
+		}}
+	}
+	for _, item := range []*Item{skopose, melk} {
+		item.Search = search(item, 1)
+		item.Enrichment = &Enrichment{State: EnrichSearching, UpdatedAt: time.Now()}
+	}
+	if err := repo.Save(cart); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+	stale, err := repo.Cart(cart.ID)
+	if err != nil {
+		t.Fatalf("Cart() error: %v", err)
+	}
+
+	// the worker moves both items along
+	for _, item := range []*Item{skopose, melk} {
+		item.Search = search(item, 3)
+		item.Enrichment = &Enrichment{State: EnrichDone, UpdatedAt: time.Now()}
+		if err := repo.SaveItem(cart.ID, item); err != nil {
+			t.Fatalf("SaveItem() error: %v", err)
+		}
+	}
+
+	// meanwhile a user checks off one of them, and renames the cart
+	stale.Get(melk.ID).Toggle("bob")
+	stale.Name = "groceries"
+	if err := repo.Save(stale); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+
+	got, err := repo.Cart(cart.ID)
+	if err != nil {
+		t.Fatalf("Cart() error: %v", err)
+	}
+	if got.Name != "groceries" {
+		t.Errorf("Expected the new name, got %q", got.Name)
+	}
+	for _, ID := range []string{skopose.ID, melk.ID} {
+		item := got.Get(ID)
+		sel := item.SearchIn(stores.ClasOhlson).Selected()
+		if sel == nil || sel.Stock != 3 || len(sel.Locations) != 1 {
+			t.Errorf("Expected the candidate of %s to be kept, got %+v", item.Text, sel)
+		}
+		if item.Enrichment == nil || item.Enrichment.State != EnrichDone {
+			t.Errorf("Expected the enrichment of %s to be kept, got %+v", item.Text, item.Enrichment)
+		}
+	}
+	if !got.Get(melk.ID).Checked || got.Get(skopose.ID).Checked {
+		t.Errorf("Expected only melk to be checked")
+	}
+}
+
+func expectEnrichment(t *testing.T, repo Repository, cartID, itemID string, want EnrichState) {
+	t.Helper()
+	expectItem(t, repo, cartID, itemID, func(item *Item) {
+		if item.Enrichment == nil || item.Enrichment.State != want {
+			t.Errorf("Expected enrichment to be %s, got %+v", want, item.Enrichment)
+		}
+	})
+}
+
+func expectItem(t *testing.T, repo Repository, cartID string, itemID string, cb func(item *Item)) {
 	cart, err := repo.Cart(cartID)
 	if err != nil {
 		t.Fatalf("Cart() error: %v", err)
@@ -74,9 +350,70 @@ func expectItem(t *testing.T, repo *SqliteRepository, cartID string, itemID stri
 	cb(item)
 }
 
-func TestCollaborator(t *testing.T) {
+func TestShops(t *testing.T) {
+	repo, _ := NewMock()
+
+	cart := New().WithCreator("alice")
+	cart.TargetStore = stores.ClasOhlson
+	cart.ShopID = "200"
+	if err := repo.Save(cart); err != nil {
+		t.Fatalf("Save() error: %v", err)
+	}
+	got, err := repo.Cart(cart.ID)
+	if err != nil {
+		t.Fatalf("Cart() error: %v", err)
+	}
+	if got.ShopID != "200" || got.CreatedBy == nil || *got.CreatedBy != "alice" {
+		t.Errorf("got shop %q, creator %v; want 200, alice", got.ShopID, got.CreatedBy)
+	}
+
+	got.ShopID = ""
+	if err := repo.Save(got); err != nil {
+		t.Fatalf("Save() error: %v", err)
+	}
+	if got, _ := repo.Cart(cart.ID); got.ShopID != "" {
+		t.Errorf("got shop %q after clearing it", got.ShopID)
+	}
+
+	if shop, err := repo.ShopPreference("alice", stores.ClasOhlson); err != nil || shop != "" {
+		t.Errorf("ShopPreference() = %q, %v; want none", shop, err)
+	}
+	for _, shopID := range []string{"200", "201"} {
+		if err := repo.SetShopPreference("alice", stores.ClasOhlson, shopID); err != nil {
+			t.Fatalf("SetShopPreference() error: %v", err)
+		}
+	}
+	if shop, _ := repo.ShopPreference("alice", stores.ClasOhlson); shop != "201" {
+		t.Errorf("ShopPreference() = %q, want 201", shop)
+	}
+	if shop, _ := repo.ShopPreference("alice", stores.Kiwi); shop != "" {
+		t.Errorf("ShopPreference(Kiwi) = %q, want none", shop)
+	}
+}
+
+func TestAreaOrder(t *testing.T) {
 	repo, _ := NewMock()
 
+	for _, areas := range [][]string{{"Hage", "Verktøy", "Elektro"}, {"Verktøy", "Hage"}} {
+		if err := repo.SetAreaOrder(stores.ClasOhlson, "200", areas); err != nil {
+			t.Fatalf("SetAreaOrder() error: %v", err)
+		}
+	}
+	got, err := repo.AreaOrder(stores.ClasOhlson, "200")
+	if err != nil {
+		t.Fatalf("AreaOrder() error: %v", err)
+	}
+	if want := []string{"Verktøy", "Hage"}; !slices.Equal(got, want) {
+		t.Errorf("AreaOrder() = %v, want %v", got, want)
+	}
+	if got, _ := repo.AreaOrder(stores.ClasOhlson, "201"); len(got) != 0 {
+		t.Errorf("AreaOrder() of another shop = %v, want none", got)
+	}
+}
+
+func TestCollaborator(t *testing.T) {
+	repo, db := NewMock()
+
 	t.Run("no collaborator", func(t *testing.T) {
 		cart := New()
 		if err := repo.Save(cart); err != nil {
@@ -91,6 +428,13 @@ func TestCollaborator(t *testing.T) {
 			t.Fatalf("Failed to save cart: %s", err)
 		}
 		expectCollaborator(t, repo, cart.ID, "user", true)
+		expectCollaboratorAdded(t, db, cart.ID, "user", "user")
+
+		// saving it again doesn't add them again
+		if err := repo.Save(cart); err != nil {
+			t.Fatalf("Failed to save cart: %s", err)
+		}
+		expectCollaboratorAdded(t, db, cart.ID, "user", "user")
 	})
 
 	t.Run("add collaborator", func(t *testing.T) {
@@ -100,14 +444,39 @@ func TestCollaborator(t *testing.T) {
 		}
 		expectCollaborator(t, repo, cart.ID, "newuser", false)
 
-		if err := repo.AddCollaborators(cart.ID, "newuser"); err != nil {
+		if err := repo.AddCollaborators(cart.ID, "alice", "newuser"); err != nil {
 			t.Fatalf("AddCollaborator() error: %v", err)
 		}
 		expectCollaborator(t, repo, cart.ID, "newuser", true)
+		expectCollaboratorAdded(t, db, cart.ID, "newuser", "alice")
+
+		if err := repo.AddCollaborators(cart.ID, "alice", "newuser"); err != nil {
+			t.Fatalf("AddCollaborator() error: %v", err)
+		}
+		expectCollaboratorAdded(t, db, cart.ID, "newuser", "alice")
 	})
 }
 
-func expectCollaborator(t *testing.T, repo *SqliteRepository, cartID string, userID string, exists bool) {
+// expectCollaboratorAdded checks that the cart has one CollaboratorAdded
+// event, for the user.
+func expectCollaboratorAdded(t *testing.T, db *sql.DB, cartID, userID, actor string) {
+	t.Helper()
+	history, err := events.NewSqlStore(db).History(cartID, 10)
+	if err != nil {
+		t.Fatalf("History() error: %v", err)
+	}
+	var added []events.CollaboratorAdded
+	for _, rec := range history {
+		if ev, ok := rec.Event.(events.CollaboratorAdded); ok {
+			added = append(added, ev)
+		}
+	}
+	if len(added) != 1 || added[0].UserID != userID || added[0].Actor != actor {
+		t.Errorf("CollaboratorAdded events = %+v, want one for %s by %s", added, userID, actor)
+	}
+}
+
+func expectCollaborator(t *testing.T, repo Repository, cartID string, userID string, exists bool) {
 	userIDs, err := repo.Collaborators(cartID)
 	if err != nil {
 		t.Fatalf("Collaborators() error: %v", err)
@@ -178,7 +547,7 @@ func NewMock(dsn ...string) (*SqliteRepository, *sql.DB) {
 		panic(err)
 	}
 
-	mustWithUsers(db, "alice", "bob")
+	mustWithUsers(db, "alice", "bob", "user", "newuser")
 
 	repo, err := NewRepository(db)
 	if err != nil {
@@ -5,17 +5,20 @@ import (
 	"log/slog"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/kvalv/shoplist/auth"
 	"github.com/kvalv/shoplist/carts"
 	"github.com/kvalv/shoplist/events"
 	"github.com/kvalv/shoplist/recipe"
+	"github.com/kvalv/shoplist/stores"
 	"github.com/starfederation/datastar-go/datastar"
 )
 
 func NewAddItem(
-	repo *carts.SqliteRepository,
-	bus *events.Bus,
+	repo carts.Repository,
+	outbox *events.Outbox,
+	enrichers stores.Enrichers,
 	log *slog.Logger,
 ) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -25,27 +28,84 @@ func NewAddItem(
 		cart, _ := repo.Latest()
 		log.Info("/add invoked", "text", signals.Text, "cartID", cart.ID)
 
-		event := events.CartUpdated{
-			CartID: cart.ID,
+		var added []events.Event
+		// items found already are left alone by the worker
+		add := func(text string, found *carts.Search) {
+			item := cart.Add(text, claims.UserID)
+			item.Search = found
+			if _, ok := enrichers.For(cart.TargetStore); ok && item.SearchIn(cart.TargetStore) == nil {
+				item.Enrichment = &carts.Enrichment{State: carts.EnrichQueued, UpdatedAt: item.CreatedAt}
+			}
+			added = append(added, events.ItemAdded{
+				CartID: cart.ID,
+				ItemID: item.ID,
+				Text:   item.Text,
+				Actor:  claims.UserID,
+				At:     item.CreatedAt,
+			})
 		}
-		if got, _ := url.ParseRequestURI(signals.Text); got != nil {
+		switch link := linkIn(signals.Text); {
+		case link == nil:
+			add(signals.Text, nil)
+		default:
+			shopID := cart.ShopID
+			if shopID == "" {
+				shopID, _ = repo.ShopPreference(claims.UserID, cart.TargetStore)
+			}
+			store, product, ok, err := enrichers.Product(r.Context(), link, cart.TargetStore, shopID)
+			if err != nil {
+				// the link is kept as it is, rather than lost
+				log.Error("failed to look up product", "link", link, "error", err)
+				add(signals.Text, nil)
+				break
+			}
+			if ok {
+				log.Info("adding product from link", "store", store, "productID", product.ID)
+				chosen := 0
+				add(product.Name, &carts.Search{Store: store, Candidates: []stores.Candidate{product}, Chosen: &chosen})
+				break
+			}
+
+			if !recipe.Supports(link) {
+				add(signals.Text, nil)
+				break
+			}
+
 			log.Info("this is a recipe, trying to parse")
-			parts, err := recipe.Parse(context.Background(), got)
+			parts, err := parseRecipe(context.Background(), link)
 			if err != nil {
-				log.Error("failed to parse recipe", "error", err)
+				log.Error("failed to parse recipe", "link", link, "error", err)
+				parts = nil
 			}
 			log.Info("parsed recipe", "parts", len(parts))
 			for _, text := range parts {
 				log.Info("adding item from recipe", "text", text)
-				item := cart.Add(text, claims.UserID)
-				event.ItemIDs = append(event.ItemIDs, item.ID)
+				add(text, nil)
+			}
+			// not a recipe after all, or it couldn't be fetched, so the link
+			// is kept as it is
+			if len(parts) == 0 {
+				add(signals.Text, nil)
 			}
-		} else {
-			item := cart.Add(signals.Text, claims.UserID)
-			event.ItemIDs = append(event.ItemIDs, item.ID)
 		}
-		repo.Save(cart)
-		bus.Publish(event)
+		if err := repo.Save(cart, added...); err != nil {
+			log.Error("failed to save cart", "error", err)
+			http.Error(w, "failed to save cart", http.StatusInternalServerError)
+			return
+		}
+		outbox.Notify()
 		datastar.NewSSE(w, r).PatchSignals([]byte(`{"text": ""}`))
 	}
 }
+
+// parseRecipe turns a recipe into the items to add. Tests replace it.
+var parseRecipe = recipe.Parse
+
+// linkIn returns the text as a URL, if it's a link to a web page.
+func linkIn(text string) *url.URL {
+	u, err := url.Parse(strings.TrimSpace(text))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil
+	}
+	return u
+}
@@ -0,0 +1,120 @@
+package commands
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/kvalv/shoplist/auth"
+	"github.com/kvalv/shoplist/carts"
+	"github.com/kvalv/shoplist/events"
+	"github.com/kvalv/shoplist/migrations"
+	"github.com/kvalv/shoplist/recipe"
+	"github.com/kvalv/shoplist/stores"
+	_ "modernc.org/sqlite"
+)
+
+func TestAddLink(t *testing.T) {
+	repo, outbox, log := newTestRepo(t)
+	cart := carts.New()
+	if err := repo.Save(cart); err != nil {
+		t.Fatalf("Save() error: %v", err)
+	}
+
+	var parsed []string
+	parseRecipe = func(ctx context.Context, link *url.URL) ([]string, error) {
+		parsed = append(parsed, link.String())
+		return []string{"kjøttdeig", "lasagneplater"}, nil
+	}
+	t.Cleanup(func() { parseRecipe = recipe.Parse })
+
+	handler := auth.NewMockAuth(&auth.Claims{UserID: "u"})(NewAddItem(repo, outbox, stores.Enrichers{}, log))
+	add := func(text string) []string {
+		t.Helper()
+		signals, _ := json.Marshal(map[string]string{"text": text})
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/add?datastar="+url.QueryEscape(string(signals)), nil))
+		c, err := repo.Cart(cart.ID)
+		if err != nil {
+			t.Fatalf("Cart() error: %v", err)
+		}
+		var texts []string
+		for _, item := range c.Items {
+			texts = append(texts, item.Text)
+		}
+		slices.Sort(texts)
+		return texts
+	}
+
+	// any other page is added as it is, without being fetched
+	link := "https://example.com/oppskrifter/lasagne"
+	if got := add(link); !slices.Equal(got, []string{link}) {
+		t.Errorf("items = %v, want the link", got)
+	}
+	if len(parsed) != 0 {
+		t.Fatalf("parsed %v, want nothing", parsed)
+	}
+
+	recipeLink := "https://www.matprat.no/oppskrifter/familie/lasagne/"
+	if got := add(recipeLink); !slices.Equal(got, []string{link, "kjøttdeig", "lasagneplater"}) {
+		t.Errorf("items = %v, want the ingredients", got)
+	}
+	if !slices.Equal(parsed, []string{recipeLink}) {
+		t.Errorf("parsed %v, want the recipe", parsed)
+	}
+
+	// a recipe that can't be fetched is added as a link
+	parseRecipe = func(ctx context.Context, link *url.URL) ([]string, error) {
+		return nil, errors.New("unavailable")
+	}
+	failedRecipe := "https://www.matprat.no/oppskrifter/familie/taco/"
+	if got := add(failedRecipe); !slices.Contains(got, failedRecipe) {
+		t.Errorf("items = %v, want the recipe link", got)
+	}
+
+	// and so is a product that can't be looked up
+	handler = auth.NewMockAuth(&auth.Claims{UserID: "u"})(NewAddItem(repo, outbox, stores.Enrichers{stores.Kiwi: failingLinker{}}, log))
+	product := "https://kiwi.no/varer/melk"
+	if got := add(product); !slices.Contains(got, product) {
+		t.Errorf("items = %v, want the product link", got)
+	}
+}
+
+// failingLinker can't look up any product.
+type failingLinker struct{}
+
+func (failingLinker) Enrich(ctx context.Context, text string) ([]stores.Candidate, error) {
+	return nil, nil
+}
+
+func (failingLinker) Product(ctx context.Context, link *url.URL) (stores.Candidate, bool, error) {
+	return stores.Candidate{}, false, errors.New("unavailable")
+}
+
+func newTestRepo(t *testing.T) (carts.Repository, *events.Outbox, *slog.Logger) {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "shop.db"))
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migrations.Migrate(db); err != nil {
+		t.Fatalf("Migrate() error: %v", err)
+	}
+	repo, err := carts.NewRepository(db)
+	if err != nil {
+		t.Fatalf("NewRepository() error: %v", err)
+	}
+	log := slog.New(slog.NewTextHandler(t.Output(), nil))
+	outbox, err := events.NewOutbox(db, nil, log)
+	if err != nil {
+		t.Fatalf("NewOutbox() error: %v", err)
+	}
+	return repo, outbox, log
+}
@@ -10,8 +10,8 @@ import (
 )
 
 func NewCheckItem(
-	repo *carts.SqliteRepository,
-	bus *events.Bus,
+	repo carts.Repository,
+	outbox *events.Outbox,
 	log *slog.Logger,
 ) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -19,10 +19,23 @@ func NewCheckItem(
 		userID := auth.ClaimsFromRequest(r).UserID
 
 		cart, _ := repo.Latest()
-		cart.Get(ID).Toggle(userID)
-		repo.Save(cart)
+		item := cart.Get(ID)
+		if item == nil {
+			http.Error(w, "item not found", http.StatusNotFound)
+			return
+		}
+		item.Toggle(userID)
 
-		bus.Publish(events.CartUpdated{CartID: cart.ID})
+		var event events.Event = events.ItemChecked{CartID: cart.ID, ItemID: ID, Actor: userID, At: item.UpdatedAt}
+		if !item.Checked {
+			event = events.ItemUnchecked{CartID: cart.ID, ItemID: ID, Actor: userID, At: item.UpdatedAt}
+		}
+		if err := repo.Save(cart, event); err != nil {
+			log.Error("failed to save cart", "error", err)
+			http.Error(w, "failed to save cart", http.StatusInternalServerError)
+			return
+		}
+		outbox.Notify()
 
 		log.Info("tick called")
 	}
@@ -0,0 +1,63 @@
+package commands
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kvalv/shoplist/auth"
+	"github.com/kvalv/shoplist/carts"
+	"github.com/kvalv/shoplist/events"
+)
+
+// NewChooseCandidate picks another of the candidates found for an item, by
+// its index.
+func NewChooseCandidate(
+	repo carts.Repository,
+	outbox *events.Outbox,
+	log *slog.Logger,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ID := r.URL.Query().Get("id")
+		idx, err := strconv.Atoi(r.URL.Query().Get("idx"))
+		if err != nil {
+			http.Error(w, "bad candidate index", http.StatusBadRequest)
+			return
+		}
+
+		cart, err := repo.Cart(SignalsFromRequest(r).Current)
+		if err != nil {
+			http.Error(w, "cart not found", http.StatusNotFound)
+			return
+		}
+		item := cart.Get(ID)
+		if item == nil {
+			http.Error(w, "item not found", http.StatusNotFound)
+			return
+		}
+		search := item.SearchIn(cart.TargetStore)
+		if search == nil || idx < 0 || idx >= len(search.Candidates) {
+			http.Error(w, "candidate not found", http.StatusNotFound)
+			return
+		}
+
+		search.Chosen = &idx
+		err = repo.SaveItem(cart.ID, item, events.CandidateChosen{
+			CartID:    cart.ID,
+			ItemID:    ID,
+			Candidate: idx,
+			Name:      search.Candidates[idx].Name,
+			Actor:     auth.ClaimsFromRequest(r).UserID,
+			At:        time.Now(),
+		})
+		if err != nil {
+			log.Error("failed to save item", "error", err)
+			http.Error(w, "failed to save item", http.StatusInternalServerError)
+			return
+		}
+		outbox.Notify()
+
+		log.Info("candidate chosen", "itemID", ID, "idx", idx)
+	}
+}
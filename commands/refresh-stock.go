@@ -0,0 +1,39 @@
+package commands
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/kvalv/shoplist/auth"
+	"github.com/kvalv/shoplist/carts"
+	"github.com/kvalv/shoplist/events"
+)
+
+// NewRefreshStock asks the worker to look up the stock of the chosen
+// candidates in the cart again, for when it's time to go shopping.
+func NewRefreshStock(
+	repo carts.Repository,
+	outbox *events.Outbox,
+	log *slog.Logger,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cart, err := repo.Cart(SignalsFromRequest(r).Current)
+		if err != nil {
+			http.Error(w, "cart not found", http.StatusNotFound)
+			return
+		}
+		err = outbox.Publish(events.StockRefreshRequested{
+			CartID: cart.ID,
+			Actor:  auth.ClaimsFromRequest(r).UserID,
+			At:     time.Now(),
+		})
+		if err != nil {
+			log.Error("failed to publish", "error", err)
+			http.Error(w, "failed to request refresh", http.StatusInternalServerError)
+			return
+		}
+
+		log.Info("stock refresh requested", "cartID", cart.ID)
+	}
+}
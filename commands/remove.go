@@ -0,0 +1,33 @@
+package commands
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/kvalv/shoplist/auth"
+	"github.com/kvalv/shoplist/carts"
+	"github.com/kvalv/shoplist/events"
+)
+
+func NewRemoveItem(
+	repo carts.Repository,
+	outbox *events.Outbox,
+	log *slog.Logger,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ID := r.URL.Query().Get("id")
+		cartID := SignalsFromRequest(r).Current
+		userID := auth.ClaimsFromRequest(r).UserID
+
+		removed := events.ItemRemoved{CartID: cartID, ItemID: ID, Actor: userID, At: time.Now()}
+		if err := repo.RemoveItem(cartID, ID, removed); err != nil {
+			log.Error("failed to remove item", "error", err)
+			http.Error(w, "failed to remove item", http.StatusInternalServerError)
+			return
+		}
+		outbox.Notify()
+
+		log.Info("item removed", "item", ID)
+	}
+}
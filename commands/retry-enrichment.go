@@ -0,0 +1,59 @@
+package commands
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kvalv/shoplist/auth"
+	"github.com/kvalv/shoplist/carts"
+	"github.com/kvalv/shoplist/events"
+)
+
+// NewRetryEnrichment puts an item back in the queue of the worker, to look
+// for candidates again. A query in the form searches by that instead of the
+// text of the item.
+func NewRetryEnrichment(
+	repo carts.Repository,
+	outbox *events.Outbox,
+	log *slog.Logger,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ID := r.URL.Query().Get("id")
+		query := strings.TrimSpace(r.FormValue("query"))
+		userID := auth.ClaimsFromRequest(r).UserID
+
+		cart, err := repo.Cart(CurrentCart(r))
+		if err != nil {
+			http.Error(w, "cart not found", http.StatusNotFound)
+			return
+		}
+		item := cart.Get(ID)
+		if item == nil {
+			http.Error(w, "item not found", http.StatusNotFound)
+			return
+		}
+		if item.Enrichment.Pending() {
+			return
+		}
+
+		now := time.Now()
+		item.Enrichment = &carts.Enrichment{State: carts.EnrichQueued, UpdatedAt: now}
+		err = repo.SaveItem(cart.ID, item, events.ItemEnrichmentRequested{
+			CartID: cart.ID,
+			ItemID: ID,
+			Query:  query,
+			Actor:  userID,
+			At:     now,
+		})
+		if err != nil {
+			log.Error("failed to save item", "error", err)
+			http.Error(w, "failed to save item", http.StatusInternalServerError)
+			return
+		}
+		outbox.Notify()
+
+		log.Info("enrichment requeued", "itemID", ID, "query", query)
+	}
+}
@@ -0,0 +1,64 @@
+package commands
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kvalv/shoplist/auth"
+	"github.com/kvalv/shoplist/carts"
+)
+
+// The item is looked for in the cart on screen, which needn't be the latest.
+func TestRetryEnrichment(t *testing.T) {
+	repo, outbox, log := newTestRepo(t)
+	older := carts.New()
+	older.CreatedAt = time.Now().Add(-time.Hour)
+	item := older.Add("skopose", "u")
+	item.Enrichment = &carts.Enrichment{State: carts.EnrichNoMatch}
+	if err := repo.Save(older); err != nil {
+		t.Fatalf("Save() error: %v", err)
+	}
+	if err := repo.Save(carts.New()); err != nil {
+		t.Fatalf("Save() error: %v", err)
+	}
+	handler := auth.NewMockAuth(&auth.Claims{UserID: "u"})(NewRetryEnrichment(repo, outbox, log))
+	expectQueued := func() {
+		t.Helper()
+		c, err := repo.Cart(older.ID)
+		if err != nil {
+			t.Fatalf("Cart() error: %v", err)
+		}
+		if e := c.Get(item.ID).Enrichment; e == nil || e.State != carts.EnrichQueued {
+			t.Fatalf("enrichment = %+v, want it queued", e)
+		}
+		// done with, for the next retry
+		c.Get(item.ID).Enrichment = &carts.Enrichment{State: carts.EnrichNoMatch}
+		if err := repo.SaveItem(c.ID, c.Get(item.ID)); err != nil {
+			t.Fatalf("SaveItem() error: %v", err)
+		}
+	}
+
+	// the retry button sends the signals
+	signals, _ := json.Marshal(map[string]string{"current": older.ID})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/retry-enrichment?id="+item.ID, strings.NewReader(string(signals))))
+	if rec.Code != 200 {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	expectQueued()
+
+	// searching again posts a form
+	form := url.Values{"current": {older.ID}, "query": {"sko"}}
+	req := httptest.NewRequest("POST", "/retry-enrichment?id="+item.ID, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	expectQueued()
+}
@@ -0,0 +1,51 @@
+package commands
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kvalv/shoplist/auth"
+	"github.com/kvalv/shoplist/carts"
+	"github.com/kvalv/shoplist/events"
+)
+
+// NewSetAreaOrder sets the order to walk the areas of a shop in, from a form
+// with the shop and the areas, one a line.
+func NewSetAreaOrder(
+	repo carts.Repository,
+	outbox *events.Outbox,
+	log *slog.Logger,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cart, err := repo.Cart(CurrentCart(r))
+		if err != nil {
+			http.Error(w, "cart not found", http.StatusNotFound)
+			return
+		}
+		shopID := r.FormValue("shop")
+		var areas []string
+		for line := range strings.Lines(r.FormValue("areas")) {
+			if area := strings.TrimSpace(line); area != "" {
+				areas = append(areas, area)
+			}
+		}
+
+		err = repo.SetAreaOrder(cart.TargetStore, shopID, areas, events.AreaOrderChanged{
+			CartID: cart.ID,
+			ShopID: shopID,
+			Areas:  areas,
+			Actor:  auth.ClaimsFromRequest(r).UserID,
+			At:     time.Now(),
+		})
+		if err != nil {
+			log.Error("failed to save area order", "error", err)
+			http.Error(w, "failed to save area order", http.StatusInternalServerError)
+			return
+		}
+		outbox.Notify()
+
+		log.Info("/set-area-order called", "shop", shopID, "areas", areas)
+	}
+}
@@ -3,18 +3,21 @@ package commands
 import (
 	"log/slog"
 	"net/http"
+	"time"
 
+	"github.com/kvalv/shoplist/auth"
 	"github.com/kvalv/shoplist/carts"
 	"github.com/kvalv/shoplist/events"
 )
 
 func NewSetName(
-	repo *carts.SqliteRepository,
-	bus *events.Bus,
+	repo carts.Repository,
+	outbox *events.Outbox,
 	log *slog.Logger,
 ) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		signals := SignalsFromRequest(r)
+		claims := auth.ClaimsFromRequest(r)
 		cartID := signals.Current
 		cart, err := repo.Cart(cartID)
 		if err != nil {
@@ -23,10 +26,15 @@ func NewSetName(
 		cart.Name = signals.Name
 		log.Info("Cart renamed", "new", cart.Name)
 
-		if err := repo.Save(cart); err != nil {
+		renamed := events.CartRenamed{
+			CartID: cartID,
+			Name:   cart.Name,
+			Actor:  claims.UserID,
+			At:     time.Now(),
+		}
+		if err := repo.Save(cart, renamed); err != nil {
 			panic("wtf do we do here then")
 		}
-
-		bus.Publish(events.CartUpdated{CartID: cartID})
+		outbox.Notify()
 	}
 }
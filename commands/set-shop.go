@@ -0,0 +1,58 @@
+package commands
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/kvalv/shoplist/auth"
+	"github.com/kvalv/shoplist/carts"
+	"github.com/kvalv/shoplist/events"
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+// NewSetShop picks which of the shops of its store the cart is for. It is
+// remembered for the user too, as the shop of their carts that have none.
+func NewSetShop(
+	repo carts.Repository,
+	outbox *events.Outbox,
+	log *slog.Logger,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var signals struct {
+			Current string `json:"current"`
+			Shop    string `json:"shop"`
+		}
+		if err := datastar.ReadSignals(r, &signals); err != nil {
+			log.Error("failed to read signals", "error", err)
+			return
+		}
+		cart, err := repo.Cart(signals.Current)
+		if err != nil {
+			http.Error(w, "cart not found", http.StatusNotFound)
+			return
+		}
+		if signals.Shop == "" || signals.Shop == cart.ShopID {
+			return
+		}
+
+		userID := auth.ClaimsFromRequest(r).UserID
+		cart.ShopID = signals.Shop
+		err = repo.Save(cart, events.ShopChanged{
+			CartID: cart.ID,
+			ShopID: cart.ShopID,
+			Actor:  userID,
+			At:     time.Now(),
+		})
+		if err != nil {
+			log.Error("failed to save cart", "error", err)
+			return
+		}
+		outbox.Notify()
+		if err := repo.SetShopPreference(userID, cart.TargetStore, cart.ShopID); err != nil {
+			log.Error("failed to save shop preference", "error", err)
+		}
+
+		log.Info("/set-shop called", "shop", cart.ShopID)
+	}
+}
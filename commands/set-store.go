@@ -1,19 +1,24 @@
 package commands
 
 import (
+	"fmt"
 	"log/slog"
 	"net/http"
 	"strconv"
+	"time"
 
+	"github.com/kvalv/shoplist/auth"
 	"github.com/kvalv/shoplist/carts"
 	"github.com/kvalv/shoplist/events"
 	"github.com/kvalv/shoplist/stores"
 	"github.com/starfederation/datastar-go/datastar"
 )
 
+// NewSetStore changes the store of the cart to one of the registry.
 func NewSetStore(
-	repo *carts.SqliteRepository,
-	bus *events.Bus,
+	repo carts.Repository,
+	outbox *events.Outbox,
+	registry stores.Registry,
 	log *slog.Logger,
 ) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -26,22 +31,40 @@ func NewSetStore(
 			return
 		}
 
-		var err error
-		if cart.TargetStore, err = parseStore(signals.Store); err != nil {
+		store, err := parseStore(registry, signals.Store)
+		if err != nil {
 			log.Error("failed to parse", "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		repo.Save(cart)
+		if store != cart.TargetStore {
+			// shops belong to a store
+			cart.ShopID = ""
+		}
+		cart.TargetStore = store
+		err = repo.Save(cart, events.TargetStoreChanged{
+			CartID: cart.ID,
+			Store:  cart.TargetStore,
+			Actor:  auth.ClaimsFromRequest(r).UserID,
+			At:     time.Now(),
+		})
+		if err != nil {
+			log.Error("failed to save cart", "error", err)
+			return
+		}
+		outbox.Notify()
 
 		log.Info("/store called", "store", cart.TargetStore)
-		bus.Publish(events.CartUpdated{CartID: cart.ID})
 	}
 }
 
-func parseStore(s string) (stores.Store, error) {
-	got, err := strconv.ParseInt(s, 10, 64)
+func parseStore(registry stores.Registry, s string) (stores.Store, error) {
+	got, err := strconv.Atoi(s)
 	if err != nil {
 		return 0, err
 	}
+	if _, ok := registry.Get(stores.Store(got)); !ok {
+		return 0, fmt.Errorf("unknown store %d", got)
+	}
 	return stores.Store(got), nil
 }
@@ -2,6 +2,7 @@ package commands
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/starfederation/datastar-go/datastar"
 )
@@ -20,3 +21,12 @@ func SignalsFromRequest(r *http.Request) *signals {
 	}
 	return &s
 }
+
+// CurrentCart returns the ID of the cart the request is about. Forms posted
+// as such don't carry the signals, so they have it in a "current" field.
+func CurrentCart(r *http.Request) string {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return r.FormValue("current")
+	}
+	return SignalsFromRequest(r).Current
+}
@@ -11,8 +11,8 @@ import (
 )
 
 func NewSwitchCart(
-	repo *carts.SqliteRepository,
-	bus *events.Bus,
+	repo carts.Repository,
+	outbox *events.Outbox,
 	log *slog.Logger,
 ) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -27,13 +27,13 @@ func NewSwitchCart(
 			name := time.Now().Format("2 January")
 			cart := carts.New().WithName(name).WithCreator(claims.UserID)
 
-			if err := repo.Save(cart); err != nil {
+			if err := repo.Save(cart, events.CartCreated{CartID: cart.ID, Actor: claims.UserID}); err != nil {
 				log.Error("failed to save cart", "error", err)
 				http.Error(w, "failed to create cart", http.StatusInternalServerError)
 				return
 			}
 			log.Info("new cart created", "cartID", cart.ID, "name", name, "createdBy", claims.UserID)
-			bus.Publish(events.CartCreated{CartID: cart.ID})
+			outbox.Notify()
 			return
 
 		}
@@ -41,6 +41,8 @@ func NewSwitchCart(
 		// TODO: something something active cart for a specific user
 		log.Info("switch-cart called", "new", signals.Current)
 
-		bus.Publish(events.CartSwitched{CartID: signals.Current, UserID: claims.UserID})
+		if err := outbox.Publish(events.CartSwitched{CartID: signals.Current, UserID: claims.UserID}); err != nil {
+			log.Error("failed to publish", "error", err)
+		}
 	}
 }
@@ -0,0 +1,418 @@
+// Package config gathers the server settings in one place.
+//
+// Settings are resolved in this order, later sources overriding earlier ones:
+//
+//  1. built-in defaults, see [Default]
+//  2. a JSON config file, given by -config or SHOPLIST_CONFIG
+//  3. environment variables, SHOPLIST_<NAME> (e.g. SHOPLIST_DB_DSN)
+//  4. command-line flags, -<name> (e.g. -db-dsn)
+//
+// Run with -help to list every setting.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Addr    string  `json:"addr"`
+	DB      DB      `json:"db"`
+	Auth    Auth    `json:"auth"`
+	Clas    Clas    `json:"clas"`
+	Kiwi    Kiwi    `json:"kiwi"`
+	Cron    Cron    `json:"cron"`
+	Bus     Bus     `json:"bus"`
+	Worker  Worker  `json:"worker"`
+	LLM     LLM     `json:"llm"`
+	Webhook Webhook `json:"webhook"`
+
+	// Debug enables pages for looking under the hood, like /debug/events.
+	Debug bool `json:"debug"`
+}
+
+type DB struct {
+	Driver string `json:"driver"` // "sqlite" or "postgres"
+	DSN    string `json:"dsn"`
+}
+
+// Auth holds the claims of the mock user every request is made as.
+type Auth struct {
+	UserID string `json:"user_id"`
+	Name   string `json:"name"`
+	Email  string `json:"email"`
+}
+
+type Clas struct {
+	StoreID   string   `json:"store_id"`
+	Cache     string   `json:"cache"`      // "memory" or "db"
+	RateLimit int      `json:"rate_limit"` // requests per second
+	Timeout   Duration `json:"timeout"`    // per request
+	Ranking   string   `json:"ranking"`    // "llm" or "simple"
+}
+
+type Kiwi struct {
+	Enabled bool     `json:"enabled"` // look up the items of Kiwi carts; off by default
+	Timeout Duration `json:"timeout"` // per request
+}
+
+type Cron struct {
+	PollInterval Duration `json:"poll_interval"`
+}
+
+// Bus decides how events reach the other instances, when running more than
+// one.
+type Bus struct {
+	Transport    string   `json:"transport"`     // "local" or "db"
+	PollInterval Duration `json:"poll_interval"` // for the db transport
+}
+
+// Worker tunes the background worker that looks up items in the store.
+type Worker struct {
+	Concurrency int      `json:"concurrency"`  // items looked up at the same time
+	MaxAttempts int      `json:"max_attempts"` // before an item is marked as failed
+	Backoff     Duration `json:"backoff"`      // before the first retry, doubled for each after
+}
+
+type LLM struct {
+	APIKey    string `json:"api_key"`
+	Model     string `json:"model"`      // for plain queries
+	ToolModel string `json:"tool_model"` // for queries that call tools
+}
+
+// Webhook is an endpoint that is posted every event, see events.Webhook.
+type Webhook struct {
+	URL string `json:"url"` // empty disables it
+}
+
+// Duration is a time.Duration that reads as "30m" in JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Default returns the settings used when nothing else is configured.
+func Default() *Config {
+	return &Config{
+		Addr: ":3001",
+		DB: DB{
+			Driver: "sqlite",
+			DSN:    "file:shop.db",
+		},
+		Auth: Auth{
+			UserID: "userID123",
+			Name:   "Markus Berg Lavby",
+			Email:  "kongenbefaler@email.com",
+		},
+		Clas: Clas{
+			StoreID:   "200",
+			Cache:     "memory",
+			RateLimit: 2,
+			Timeout:   Duration(10 * time.Second),
+			Ranking:   "llm",
+		},
+		Kiwi: Kiwi{Timeout: Duration(10 * time.Second)},
+		Cron: Cron{PollInterval: Duration(30 * time.Minute)},
+		Bus: Bus{
+			Transport:    "local",
+			PollInterval: Duration(100 * time.Millisecond),
+		},
+		Worker: Worker{
+			Concurrency: 4,
+			MaxAttempts: 5,
+			Backoff:     Duration(2 * time.Second),
+		},
+		LLM: LLM{
+			Model:     "gemini-2.5-flash",
+			ToolModel: "gemini-3-flash-preview",
+		},
+	}
+}
+
+// field describes a setting that can be given as an environment variable
+// and a flag. The config file goes through the json tags instead.
+type field struct {
+	name   string // flag name; the env variable is derived from it
+	usage  string
+	secret bool
+	value  func(c *Config) any // pointer to the field
+}
+
+var fields = []field{
+	{name: "addr", usage: "listen address", value: func(c *Config) any { return &c.Addr }},
+	{name: "db-driver", usage: `database driver, "sqlite" or "postgres"`, value: func(c *Config) any { return &c.DB.Driver }},
+	{name: "db-dsn", usage: "database connection string", secret: true, value: func(c *Config) any { return &c.DB.DSN }},
+	{name: "auth-user-id", usage: "user ID of the mock user", value: func(c *Config) any { return &c.Auth.UserID }},
+	{name: "auth-name", usage: "name of the mock user", value: func(c *Config) any { return &c.Auth.Name }},
+	{name: "auth-email", usage: "email of the mock user", value: func(c *Config) any { return &c.Auth.Email }},
+	{name: "clas-store-id", usage: "Clas Ohlson store used for stock and shelf lookups, unless picked for the cart", value: func(c *Config) any { return &c.Clas.StoreID }},
+	{name: "clas-cache", usage: `where responses from clasohlson.com are cached, "memory" or "db"`, value: func(c *Config) any { return &c.Clas.Cache }},
+	{name: "clas-rate-limit", usage: "requests per second to clasohlson.com", value: func(c *Config) any { return &c.Clas.RateLimit }},
+	{name: "clas-timeout", usage: "timeout of a request to clasohlson.com", value: func(c *Config) any { return &c.Clas.Timeout }},
+	{name: "clas-ranking", usage: `how products are ranked, "llm" (falling back on "simple" when it fails) or "simple" (by name, reviews and stock)`, value: func(c *Config) any { return &c.Clas.Ranking }},
+	{name: "kiwi-enabled", usage: "look up the items of Kiwi carts in the Kiwi catalogue", value: func(c *Config) any { return &c.Kiwi.Enabled }},
+	{name: "kiwi-timeout", usage: "timeout of a request to the Kiwi catalogue", value: func(c *Config) any { return &c.Kiwi.Timeout }},
+	{name: "cron-poll-interval", usage: "how often cron checks for due jobs", value: func(c *Config) any { return &c.Cron.PollInterval }},
+	{name: "bus-transport", usage: `how events reach other instances, "local" (they don't) or "db"`, value: func(c *Config) any { return &c.Bus.Transport }},
+	{name: "bus-poll-interval", usage: "how often the db transport checks for events", value: func(c *Config) any { return &c.Bus.PollInterval }},
+	{name: "worker-concurrency", usage: "items the worker looks up at the same time", value: func(c *Config) any { return &c.Worker.Concurrency }},
+	{name: "worker-max-attempts", usage: "attempts at looking up an item before it is marked as failed", value: func(c *Config) any { return &c.Worker.MaxAttempts }},
+	{name: "worker-backoff", usage: "wait before the worker retries an item, doubled for each retry", value: func(c *Config) any { return &c.Worker.Backoff }},
+	{name: "llm-api-key", usage: "Gemini API key, GEMINI_API_KEY is also read", secret: true, value: func(c *Config) any { return &c.LLM.APIKey }},
+	{name: "llm-model", usage: "Gemini model for plain queries", value: func(c *Config) any { return &c.LLM.Model }},
+	{name: "llm-tool-model", usage: "Gemini model for queries that call tools", value: func(c *Config) any { return &c.LLM.ToolModel }},
+	{name: "debug", usage: "enable the debug pages", value: func(c *Config) any { return &c.Debug }},
+	// webhook URLs tend to carry a token, so it's kept out of the logs
+	{name: "webhook-url", usage: "URL that is posted every event as JSON, empty disables it", secret: true, value: func(c *Config) any { return &c.Webhook.URL }},
+}
+
+func (f field) env() string {
+	return "SHOPLIST_" + strings.ToUpper(strings.ReplaceAll(f.name, "-", "_"))
+}
+
+// aliases are environment variables read before the SHOPLIST_ ones, for
+// settings that already had a conventional name.
+var aliases = map[string]string{
+	"llm-api-key": "GEMINI_API_KEY",
+}
+
+// Load resolves the configuration from the command-line arguments (without
+// the program name) and the environment, and validates it.
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	fs := flag.NewFlagSet("shoplist", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	path := fs.String("config", getenv("SHOPLIST_CONFIG"), "path to a JSON config file")
+
+	// Flags win over everything else, so they're collected here and applied
+	// once the file and the environment have been read.
+	var flags []func(c *Config) error
+	for _, f := range fields {
+		apply := func(s string) error {
+			if err := set(f.value(Default()), s); err != nil {
+				return err
+			}
+			flags = append(flags, func(c *Config) error { return set(f.value(c), s) })
+			return nil
+		}
+		// so that -debug works without a value
+		if _, ok := f.value(Default()).(*bool); ok {
+			fs.BoolFunc(f.name, f.usage, apply)
+			continue
+		}
+		fs.Func(f.name, f.usage, apply)
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			fs.SetOutput(os.Stderr)
+			fs.PrintDefaults()
+		}
+		return nil, err
+	}
+
+	cfg := Default()
+	if *path != "" {
+		if err := cfg.readFile(*path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range fields {
+		for _, key := range []string{aliases[f.name], f.env()} {
+			if key == "" {
+				continue
+			}
+			if v := getenv(key); v != "" {
+				if err := set(f.value(cfg), v); err != nil {
+					return nil, fmt.Errorf("%s: %w", key, err)
+				}
+			}
+		}
+	}
+
+	for _, apply := range flags {
+		if err := apply(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func set(ptr any, s string) error {
+	switch p := ptr.(type) {
+	case *string:
+		*p = s
+	case *Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*p = Duration(d)
+	case *int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		*p = n
+	case *bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		*p = b
+	default:
+		panic(fmt.Sprintf("config: unsupported field type %T", ptr))
+	}
+	return nil
+}
+
+// Validate reports every setting that is missing or malformed.
+func (c *Config) Validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("addr: %w", err))
+	}
+	switch c.DB.Driver {
+	case "sqlite", "postgres":
+	default:
+		errs = append(errs, fmt.Errorf("db-driver: must be sqlite or postgres, got %q", c.DB.Driver))
+	}
+	for _, f := range fields {
+		if s, ok := f.value(c).(*string); ok && *s == "" && !f.secret {
+			errs = append(errs, fmt.Errorf("%s: must not be empty", f.name))
+		}
+	}
+	if c.DB.DSN == "" {
+		errs = append(errs, fmt.Errorf("db-dsn: must not be empty"))
+	}
+	if c.Webhook.URL != "" {
+		if u, err := url.Parse(c.Webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("webhook-url: must be an http(s) URL"))
+		}
+	}
+	switch c.Clas.Cache {
+	case "memory", "db":
+	default:
+		errs = append(errs, fmt.Errorf("clas-cache: must be memory or db, got %q", c.Clas.Cache))
+	}
+	switch c.Clas.Ranking {
+	case "llm", "simple":
+	default:
+		errs = append(errs, fmt.Errorf("clas-ranking: must be llm or simple, got %q", c.Clas.Ranking))
+	}
+	if c.Clas.RateLimit <= 0 {
+		errs = append(errs, fmt.Errorf("clas-rate-limit: must be positive"))
+	}
+	if c.Clas.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("clas-timeout: must be positive"))
+	}
+	if c.Kiwi.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("kiwi-timeout: must be positive"))
+	}
+	if c.Cron.PollInterval <= 0 {
+		errs = append(errs, fmt.Errorf("cron-poll-interval: must be positive"))
+	}
+	switch c.Bus.Transport {
+	case "local", "db":
+	default:
+		errs = append(errs, fmt.Errorf("bus-transport: must be local or db, got %q", c.Bus.Transport))
+	}
+	if c.Bus.PollInterval <= 0 {
+		errs = append(errs, fmt.Errorf("bus-poll-interval: must be positive"))
+	}
+	if c.Worker.Concurrency <= 0 {
+		errs = append(errs, fmt.Errorf("worker-concurrency: must be positive"))
+	}
+	if c.Worker.MaxAttempts <= 0 {
+		errs = append(errs, fmt.Errorf("worker-max-attempts: must be positive"))
+	}
+	if c.Worker.Backoff <= 0 {
+		errs = append(errs, fmt.Errorf("worker-backoff: must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// LogValue implements [slog.LogValuer], so the effective configuration can be
+// logged as is. Secrets are redacted.
+func (c *Config) LogValue() slog.Value {
+	attrs := make([]slog.Attr, len(fields))
+	for i, f := range fields {
+		attrs[i] = slog.String(f.name, c.display(f))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+func (c *Config) display(f field) string {
+	var s string
+	switch v := f.value(c).(type) {
+	case *string:
+		s = *v
+	case *Duration:
+		s = time.Duration(*v).String()
+	case *int:
+		s = strconv.Itoa(*v)
+	case *bool:
+		s = strconv.FormatBool(*v)
+	}
+	if !f.secret || s == "" {
+		return s
+	}
+	if f.name == "db-dsn" {
+		return redactDSN(s)
+	}
+	return "[redacted]"
+}
+
+var passwordKV = regexp.MustCompile(`(password\s*=\s*)('[^']*'|\S+)`)
+
+// redactDSN hides the password of a connection string, be it a URL or in
+// the key=value form.
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return passwordKV.ReplaceAllString(dsn, "${1}[redacted]")
+}
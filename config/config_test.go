@@ -0,0 +1,100 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{
+		"addr": ":4000",
+		"db": {"driver": "postgres", "dsn": "host=db password=hunter2"},
+		"clas": {"store_id": "file"},
+		"cron": {"poll_interval": "5m"}
+	}`), 0o600)
+	if err != nil {
+		t.Fatalf("failed to write config file: %s", err)
+	}
+
+	env := map[string]string{
+		"SHOPLIST_CONFIG":             path,
+		"SHOPLIST_CLAS_STORE_ID":      "env",
+		"SHOPLIST_LLM_MODEL":          "env-model",
+		"SHOPLIST_WORKER_CONCURRENCY": "8",
+		"GEMINI_API_KEY":              "secret",
+	}
+	cfg, err := Load([]string{"-llm-model", "flag-model", "-debug"}, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+
+	cases := []struct {
+		name      string
+		got, want any
+	}{
+		{"default", cfg.Auth.UserID, "userID123"},
+		{"file", cfg.Addr, ":4000"},
+		{"file", cfg.DB.Driver, "postgres"},
+		{"file", cfg.Cron.PollInterval, Duration(5 * time.Minute)},
+		{"env over file", cfg.Clas.StoreID, "env"},
+		{"alias", cfg.LLM.APIKey, "secret"},
+		{"flag over env", cfg.LLM.Model, "flag-model"},
+		{"bool flag", cfg.Debug, true},
+		{"int env", cfg.Worker.Concurrency, 8},
+	}
+	for _, tc := range cases {
+		if tc.got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, tc.got, tc.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	getenv := func(string) string { return "" }
+
+	if _, err := Load(nil, getenv); err != nil {
+		t.Fatalf("defaults should be valid: %v", err)
+	}
+
+	_, err := Load([]string{"-addr", "nope", "-db-driver", "mysql", "-cron-poll-interval", "0s", "-auth-user-id", "", "-webhook-url", "ftp://hooks", "-bus-transport", "redis", "-worker-max-attempts", "0", "-clas-cache", "redis", "-clas-ranking", "coin"}, getenv)
+	if err == nil {
+		t.Fatalf("expected validation errors")
+	}
+	for _, want := range []string{"addr", "db-driver", "cron-poll-interval", "auth-user-id", "webhook-url", "bus-transport", "worker-max-attempts", "clas-cache", "clas-ranking"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %s, got: %v", want, err)
+		}
+	}
+
+	if _, err := Load([]string{"-cron-poll-interval", "often"}, getenv); err == nil {
+		t.Fatalf("expected an error for a malformed duration")
+	}
+	if _, err := Load([]string{"-worker-concurrency", "lots"}, getenv); err == nil {
+		t.Fatalf("expected an error for a malformed number")
+	}
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	for _, dsn := range []string{
+		"host=db user=shop password=hunter2 sslmode=disable",
+		"postgres://shop:hunter2@db/shop",
+	} {
+		cfg := Default()
+		cfg.DB.DSN = dsn
+		cfg.LLM.APIKey = "hunter2"
+
+		var out strings.Builder
+		slog.New(slog.NewTextHandler(&out, nil)).Info("config", "config", cfg)
+		if strings.Contains(out.String(), "hunter2") {
+			t.Fatalf("secret leaked:\n%s", out.String())
+		}
+		if !strings.Contains(out.String(), "db") {
+			t.Fatalf("expected the rest of the dsn to be shown:\n%s", out.String())
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"testing/synctest"
 	"time"
 
+	"github.com/kvalv/shoplist/migrations"
 	_ "modernc.org/sqlite"
 )
 
@@ -14,6 +15,9 @@ func TestBackendSqlite(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to open db: %s", err)
 	}
+	if err := migrations.Migrate(db); err != nil {
+		t.Fatalf("failed to migrate: %s", err)
+	}
 	backend := BackendSqlite(db)
 
 	synctest.Test(t, func(t *testing.T) {
@@ -31,7 +35,8 @@ func TestBackendSqlite(t *testing.T) {
 			t.Fatalf("expected timestamp to be non-nil")
 		}
 
-		want := "2000-01-01 01:00:00"
+		// the synctest clock starts at midnight UTC
+		want := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).Local().Format(time.DateTime)
 		if got := ts.Format(time.DateTime); got != want {
 			t.Fatalf("unexpected timestamp: got %q, want %q", got, want)
 		}
@@ -8,6 +8,8 @@ import (
 	"testing"
 	"testing/synctest"
 	"time"
+
+	"github.com/kvalv/shoplist/migrations"
 )
 
 func TestSchedule(t *testing.T) {
@@ -124,6 +126,9 @@ func TestCron(t *testing.T) {
 			t.Fatalf("failed to open db: %s", err)
 		}
 		defer db.Close()
+		if err := migrations.Migrate(db); err != nil {
+			t.Fatalf("failed to migrate: %s", err)
+		}
 		cron := New(t.Context(), BackendSqlite(db)).WithLogger(slog.New(slog.NewTextHandler(t.Output(), nil)))
 
 		// var count int
@@ -0,0 +1,87 @@
+package cron
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/kvalv/shoplist/dialect"
+)
+
+type postgres struct {
+	db *sql.DB
+}
+
+// BackendPostgres stores job metadata in the cron_jobs table of a Postgres
+// database, see migrations/postgres.sql.
+func BackendPostgres(db *sql.DB) Backend {
+	return &postgres{db: db}
+}
+
+// Register implements [Backend].
+func (p *postgres) Register(name string, lastExecuted time.Time) error {
+	_, err := p.db.Exec(dialect.Postgres.Rebind(`
+		insert into cron_jobs(name, attempt, executed_at)
+		values (?, 0, ?)
+		on conflict(name) do nothing;
+	`), name, lastExecuted)
+	if err != nil {
+		return fmt.Errorf("sql: %w", err)
+	}
+	return nil
+}
+
+// LastExecutionFor implements [Backend].
+func (p *postgres) LastExecutionFor(name string) (*time.Time, int, error) {
+	var (
+		ts      sql.NullTime
+		attempt int
+	)
+	row := p.db.QueryRow(dialect.Postgres.Rebind(`
+		select executed_at, attempt
+		from cron_jobs
+		where name = ?;
+	`), name)
+	if err := row.Scan(&ts, &attempt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	if !ts.Valid {
+		return nil, attempt, nil
+	}
+	return ptr(ts.Time), attempt, nil
+}
+
+// JobFailed implements [Backend].
+func (p *postgres) JobFailed(name string, errmsg string) error {
+	_, err := p.db.Exec(dialect.Postgres.Rebind(`
+		insert into cron_jobs(name, attempt, last_error, executed_at)
+		values (?, 1, ?, ?)
+		on conflict(name) do update set
+			attempt = cron_jobs.attempt + 1,
+			last_error = excluded.last_error,
+			executed_at = excluded.executed_at;
+	`), name, errmsg, time.Now())
+	if err != nil {
+		return fmt.Errorf("sql: %w", err)
+	}
+	return nil
+}
+
+// JobSucceeded implements [Backend].
+func (p *postgres) JobSucceeded(name string) error {
+	_, err := p.db.Exec(dialect.Postgres.Rebind(`
+		insert into cron_jobs(name, attempt, last_error, executed_at)
+		values (?, 0, null, ?)
+		on conflict(name) do update set
+			attempt = 0,
+			last_error = null,
+			executed_at = excluded.executed_at;
+	`), name, time.Now())
+	if err != nil {
+		return fmt.Errorf("sql: %w", err)
+	}
+	return nil
+}
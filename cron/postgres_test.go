@@ -0,0 +1,63 @@
+package cron
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kvalv/shoplist/migrations"
+	"github.com/kvalv/shoplist/pgtest"
+)
+
+func TestMain(m *testing.M) { os.Exit(pgtest.Main(m)) }
+
+func TestBackendPostgres(t *testing.T) {
+	db := pgtest.Open(t)
+	if err := migrations.MigratePostgres(db); err != nil {
+		t.Fatalf("failed to migrate: %s", err)
+	}
+	backend := BackendPostgres(db)
+
+	registered := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := backend.Register("job", registered); err != nil {
+		t.Fatalf("failed to register: %s", err)
+	}
+	// registering again keeps the original timestamp
+	if err := backend.Register("job", time.Now()); err != nil {
+		t.Fatalf("failed to register twice: %s", err)
+	}
+	ts, attempt, err := backend.LastExecutionFor("job")
+	if err != nil {
+		t.Fatalf("failed to get last execution: %s", err)
+	}
+	if ts == nil || !ts.Equal(registered) {
+		t.Fatalf("unexpected timestamp: got %v, want %v", ts, registered)
+	}
+	if attempt != 0 {
+		t.Fatalf("unexpected attempt: got %d, want 0", attempt)
+	}
+
+	for range 2 {
+		if err := backend.JobFailed("job", "some error"); err != nil {
+			t.Fatalf("failed to register failed attempt: %s", err)
+		}
+	}
+	if _, attempt, _ = backend.LastExecutionFor("job"); attempt != 2 {
+		t.Fatalf("unexpected attempt: got %d, want 2", attempt)
+	}
+
+	if err := backend.JobSucceeded("job"); err != nil {
+		t.Fatalf("failed to register successful attempt: %s", err)
+	}
+	ts, attempt, _ = backend.LastExecutionFor("job")
+	if attempt != 0 {
+		t.Fatalf("unexpected attempt: got %d, want 0", attempt)
+	}
+	if ts == nil || time.Since(*ts) > time.Minute {
+		t.Fatalf("expected a recent timestamp, got %v", ts)
+	}
+
+	if ts, _, err := backend.LastExecutionFor("unknown"); err != nil || ts != nil {
+		t.Fatalf("unknown job: got %v, %v; want nil, nil", ts, err)
+	}
+}
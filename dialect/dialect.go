@@ -0,0 +1,47 @@
+// Package dialect lets the same queries run on SQLite and Postgres. Queries
+// are written with '?' placeholders, and rebound for the database they run on.
+package dialect
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+type Dialect int
+
+const (
+	SQLite Dialect = iota
+	Postgres
+)
+
+// Of returns the dialect of the database, by its driver.
+func Of(db *sql.DB) Dialect {
+	if _, ok := db.Driver().(*pq.Driver); ok {
+		return Postgres
+	}
+	return SQLite
+}
+
+// Rebind rewrites the '?' placeholders in a query to the style of the
+// dialect. SQLite takes them as they are, and Postgres wants $1, $2, ...
+func (d Dialect) Rebind(query string) string {
+	if d != Postgres {
+		return query
+	}
+	var (
+		b strings.Builder
+		n int
+	)
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+	return b.String()
+}
@@ -0,0 +1,33 @@
+package dialect
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+func TestRebind(t *testing.T) {
+	query := `SELECT id FROM items WHERE cart_id = ? AND text = ?`
+	if got := SQLite.Rebind(query); got != query {
+		t.Fatalf("sqlite: got %q, want unchanged", got)
+	}
+	want := `SELECT id FROM items WHERE cart_id = $1 AND text = $2`
+	if got := Postgres.Rebind(query); got != want {
+		t.Fatalf("postgres: got %q, want %q", got, want)
+	}
+}
+
+func TestOf(t *testing.T) {
+	for driver, want := range map[string]Dialect{"sqlite": SQLite, "postgres": Postgres} {
+		db, err := sql.Open(driver, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := Of(db); got != want {
+			t.Errorf("Of(%s) = %v, want %v", driver, got, want)
+		}
+		db.Close()
+	}
+}
@@ -1,15 +1,33 @@
 package events
 
 import (
+	"context"
 	"log/slog"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// A simple bus for publishing and subscribing to events of type T
+// A simple bus for publishing and subscribing to events of type T.
+//
+// Each subscriber has its own queue, and a goroutine handing the events over
+// from it, so Publish never waits for a subscriber and a slow subscriber
+// never holds up the others. What happens when it falls behind is decided
+// per subscription, see [Policy].
+//
+// A bus only reaches the subscribers of its own process, unless it has a
+// [Transport] to the buses of other instances.
 type Bus struct {
-	subs []*subscriber[Event]
-	mu   sync.Mutex
-	log  *slog.Logger
+	subs      []sink
+	tracers   []*subscriber[Trace]
+	mu        sync.Mutex
+	log       *slog.Logger
+	transport Transport
+
+	published    atomic.Int64
+	dropped      atomic.Int64
+	disconnected atomic.Int64
 }
 
 // Creates a new event bus
@@ -17,43 +35,456 @@ func NewBus(log *slog.Logger) *Bus {
 	return &Bus{log: log}
 }
 
+// Transport carries published events to the bus of every instance, this one
+// included. See [NewDBTransport].
+type Transport interface {
+	// Send hands the event to every instance.
+	Send(ev Event) error
+
+	// Listen calls deliver for every event sent by any instance, until the
+	// context is done.
+	Listen(ctx context.Context, deliver func(Event)) error
+}
+
+// WithTransport makes Publish go through the transport, so that subscribers
+// on other instances get the event too. Run must be called to receive.
+func (b *Bus) WithTransport(t Transport) *Bus {
+	b.transport = t
+	return b
+}
+
+// Run hands events from the transport to the subscribers, until the context
+// is done.
+func (b *Bus) Run(ctx context.Context) {
+	if b.transport == nil {
+		return
+	}
+	if err := b.transport.Listen(ctx, b.local); err != nil && ctx.Err() == nil {
+		b.log.Error("transport stopped", "error", err)
+	}
+}
+
+// Policy decides what happens to a subscriber that doesn't keep up with the
+// events, once its channel is full.
+type Policy int
+
+const (
+	// Block has each event wait up to the subscription's timeout for room
+	// in the channel, from when it was published, and drops it if there is
+	// none by then. At most Buffer events wait; one that comes when they
+	// are all waiting is dropped right away.
+	Block Policy = iota
+	// DropOldest discards the oldest event to make room. Fits subscribers
+	// that only care about the latest state, like renderers.
+	DropOldest
+	// Disconnect closes the subscription. The subscriber sees its channel
+	// closed and has to subscribe again.
+	Disconnect
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Block:
+		return "block"
+	case DropOldest:
+		return "drop-oldest"
+	case Disconnect:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+type SubscribeOptions struct {
+	Policy  Policy
+	Timeout time.Duration // how long Block waits; defaults to one second
+	Buffer  int           // size of the channel, and of the queue in front of it; defaults to 10
+	Name    string        // identifies the subscriber in logs
+
+	// Filter, if set, decides which events the subscriber gets. See
+	// [ForCart] and [ForUser].
+	Filter func(Event) bool
+}
+
+// sink is the part of a subscriber the bus sees, whatever type of events it
+// receives.
+type sink interface {
+	deliver(b *Bus, ev Event) bool
+	info() SubscriberInfo
+}
+
 func (b *Bus) Publish(t Event) {
+	if b.transport != nil {
+		if err := b.transport.Send(t); err != nil {
+			b.log.Error("failed to send event", "error", err)
+		}
+		return
+	}
+	b.local(t)
+}
+
+// local queues an event for the subscribers of this bus.
+func (b *Bus) local(t Event) {
+	start := time.Now()
+	b.published.Add(1)
+
 	b.mu.Lock()
-	defer b.mu.Unlock()
-	for _, s := range b.subs {
-		if s.closed {
-			continue
+	subs := slices.Clone(b.subs)
+	tracers := slices.Clone(b.tracers)
+	b.mu.Unlock()
+
+	var delivered int
+	for _, s := range subs {
+		if s.deliver(b, t) {
+			delivered++
+		}
+	}
+
+	if len(tracers) == 0 {
+		return
+	}
+	trace := Trace{
+		Event:       t,
+		Type:        typeName(t),
+		Subscribers: delivered,
+		Latency:     time.Since(start),
+		At:          start,
+	}
+	for _, s := range tracers {
+		s.queue(b, trace)
+	}
+}
+
+// deliver queues the event for the subscriber, if it wants it.
+func (s *subscriber[T]) deliver(b *Bus, event Event) bool {
+	ev, ok := event.(T)
+	if !ok {
+		return false
+	}
+	if s.opts.Filter != nil && !s.opts.Filter(event) {
+		return false
+	}
+	s.queue(b, ev)
+	return true
+}
+
+// queue puts the event in the queue of the subscriber, for run to hand over.
+// It never waits. The queue is as big as the channel, and when it's full the
+// policy decides what gives. With the Block policy, the events in it wait for
+// as long as the timeout allows.
+func (s *subscriber[T]) queue(b *Bus, ev T) {
+	s.mu.Lock()
+	if s.closed.Load() {
+		s.mu.Unlock()
+		return
+	}
+	if len(s.queued) == s.opts.Buffer {
+		switch s.opts.Policy {
+		case Block:
+			s.mu.Unlock()
+			s.drop(b)
+			b.log.Warn("subscriber too slow, dropped event", "subscriber", s.opts.Name)
+			return
+		case DropOldest:
+			s.queued[0] = queued[T]{}
+			s.queued = s.queued[1:]
+			s.drop(b)
+		case Disconnect:
+			s.mu.Unlock()
+			s.drop(b)
+			s.disconnect(b)
+			return
+		}
+	}
+	s.queued = append(s.queued, queued[T]{ev: ev, at: time.Now()})
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next takes the oldest event off the queue.
+func (s *subscriber[T]) next() (queued[T], bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queued) == 0 {
+		return queued[T]{}, false
+	}
+	q := s.queued[0]
+	s.queued[0] = queued[T]{}
+	s.queued = s.queued[1:]
+	return q, true
+}
+
+// run hands the queued events to the subscriber, until it's closed.
+func (s *subscriber[T]) run(b *Bus) {
+	defer close(s.stopped)
+	defer close(s.Ch)
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.wake:
+		}
+		for q, ok := s.next(); ok; q, ok = s.next() {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			if !s.send(b, q) {
+				return
+			}
+		}
+	}
+}
+
+// send hands the event to the subscriber, as its policy says. It returns
+// false once the subscriber is disconnected.
+func (s *subscriber[T]) send(b *Bus, q queued[T]) bool {
+	ev := q.ev
+	select {
+	case s.Ch <- ev:
+		return true
+	default:
+	}
+
+	switch s.opts.Policy {
+	case Block:
+		// the time spent in the queue counts
+		timer := time.NewTimer(time.Until(q.at.Add(s.opts.Timeout)))
+		defer timer.Stop()
+		select {
+		case s.Ch <- ev:
+		case <-s.done:
+		case <-timer.C:
+			s.drop(b)
+			b.log.Warn("subscriber too slow, dropped event", "subscriber", s.opts.Name)
+		}
+
+	case DropOldest:
+		for {
+			select {
+			case s.Ch <- ev:
+				return true
+			default:
+			}
+			select {
+			case <-s.Ch:
+				s.drop(b)
+			default:
+			}
 		}
-		s.Ch <- t
+
+	case Disconnect:
+		s.drop(b)
+		s.disconnect(b)
+		return false
+	}
+	return true
+}
+
+type queued[T any] struct {
+	ev T
+	at time.Time
+}
+
+// disconnect closes the subscription, once.
+func (s *subscriber[T]) disconnect(b *Bus) {
+	if s.disconnecting.CompareAndSwap(false, true) {
+		b.disconnected.Add(1)
+		b.log.Warn("subscriber too slow, disconnecting", "subscriber", s.opts.Name)
+		// Close waits for run, which may be the caller
+		go s.Close()
 	}
 }
 
-func (b *Bus) Subscribe() *subscriber[Event] {
+// Subscribe returns a subscription to every event on the bus, or the ones
+// passing the filter of the options.
+func (b *Bus) Subscribe(opts ...SubscribeOptions) *subscriber[Event] {
+	return SubscribeTo[Event](b, opts...)
+}
+
+// SubscribeTo returns a subscription to the events of type T only, e.g.
+//
+//	sub := events.SubscribeTo[events.CartUpdated](bus)
+//	for ev := range sub.Ch {
+//		fmt.Println(ev.CartID)
+//	}
+func SubscribeTo[T Event](b *Bus, opts ...SubscribeOptions) *subscriber[T] {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sub := newSubscriber[T](b, opts, func(s *subscriber[T]) {
+		b.subs = slices.DeleteFunc(b.subs, func(s2 sink) bool { return s2 == sink(s) })
+	})
+	b.subs = append(b.subs, sub)
+	return sub
+}
+
+// Trace is what happened when an event was published.
+type Trace struct {
+	Event       Event
+	Type        string
+	Subscribers int           // how many subscribers the event was queued for
+	Latency     time.Duration // time spent queueing the event for the subscribers
+	At          time.Time
+}
+
+// Trace returns a subscription to a [Trace] of every published event, for
+// debugging. It's not in the list of subscribers, and it never holds up the
+// bus: when its queue is full, the oldest traces are dropped.
+func (b *Bus) Trace(buffer int) *subscriber[Trace] {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	ch := make(chan Event, 10)
-	sub := &subscriber[Event]{
-		Ch: ch,
+	opts := SubscribeOptions{Policy: DropOldest, Buffer: buffer, Name: "trace"}
+	sub := newSubscriber[Trace](b, []SubscribeOptions{opts}, func(s *subscriber[Trace]) {
+		b.tracers = slices.DeleteFunc(b.tracers, func(s2 *subscriber[Trace]) bool { return s2 == s })
+	})
+	sub.tracer = true
+	b.tracers = append(b.tracers, sub)
+	return sub
+}
+
+// newSubscriber creates a subscriber, which calls remove with the bus locked
+// once it's closed.
+func newSubscriber[T any](b *Bus, opts []SubscribeOptions, remove func(s *subscriber[T])) *subscriber[T] {
+	var opt SubscribeOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = time.Second
+	}
+	if opt.Buffer <= 0 {
+		opt.Buffer = 10
+	}
+
+	sub := &subscriber[T]{
+		Ch:      make(chan T, opt.Buffer),
+		opts:    opt,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
 	}
 
 	sub.close = sync.OnceFunc(func() {
+		// run closes the channel on its way out, being the only sender
+		sub.mu.Lock()
+		sub.closed.Store(true)
+		sub.queued = nil
+		sub.mu.Unlock()
+		close(sub.done)
+		<-sub.stopped
+
 		b.mu.Lock()
-		defer b.mu.Unlock()
-		close(ch)
-		sub.closed = true
-		b.log.Info("subscriber closed")
+		remove(sub)
+		b.mu.Unlock()
+		b.log.Info("subscriber closed", "subscriber", opt.Name)
 	})
-
-	b.subs = append(b.subs, sub)
+	go sub.run(b)
 	return sub
 }
 
+// BusStats are counters over the lifetime of a bus.
+type BusStats struct {
+	Published    int64
+	Dropped      int64 // events not delivered to a subscriber, summed over subscribers
+	Disconnected int64 // subscribers closed by the Disconnect policy
+}
+
+// Subscribers returns the number of open subscriptions.
+func (b *Bus) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+// SubscriberInfo describes a subscription, for debugging.
+type SubscriberInfo struct {
+	Name     string
+	Policy   Policy
+	Queued   int // events waiting to be read
+	Capacity int
+	Dropped  int64
+}
+
+// Subscriptions describes the open subscriptions, in the order they were
+// made.
+func (b *Bus) Subscriptions() []SubscriberInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	infos := make([]SubscriberInfo, len(b.subs))
+	for i, s := range b.subs {
+		infos[i] = s.info()
+	}
+	return infos
+}
+
+func (b *Bus) Stats() BusStats {
+	return BusStats{
+		Published:    b.published.Load(),
+		Dropped:      b.dropped.Load(),
+		Disconnected: b.disconnected.Load(),
+	}
+}
+
 type subscriber[T any] struct {
-	closed bool
-	Ch     chan T
-	close  func()
+	closed  atomic.Bool
+	Ch      chan T
+	close   func()
+	opts    SubscribeOptions
+	dropped atomic.Int64
+
+	mu            sync.Mutex
+	queued        []queued[T]   // events waiting for run to hand them over
+	wake          chan struct{} // tells run there's something in the queue
+	done          chan struct{} // closed by Close
+	stopped       chan struct{} // closed when run returns
+	disconnecting atomic.Bool
+	tracer        bool // its drops are not the bus's
 }
 
 func (s *subscriber[T]) Close() {
 	s.close()
 }
+
+func (s *subscriber[T]) info() SubscriberInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return SubscriberInfo{
+		Name:     s.opts.Name,
+		Policy:   s.opts.Policy,
+		Queued:   len(s.queued) + len(s.Ch),
+		Capacity: cap(s.Ch),
+		Dropped:  s.Dropped(),
+	}
+}
+
+// Dropped returns how many events this subscriber has missed.
+func (s *subscriber[T]) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+func (s *subscriber[T]) drop(b *Bus) {
+	s.dropped.Add(1)
+	if !s.tracer {
+		b.dropped.Add(1)
+	}
+}
+
+// ForCart is a filter for events that concern one of the given carts.
+func ForCart(cartIDs ...string) func(Event) bool {
+	return func(ev Event) bool {
+		cartID, _ := describe(ev)
+		return cartID != "" && slices.Contains(cartIDs, cartID)
+	}
+}
+
+// ForUser is a filter for events done by, or concerning, the given user.
+func ForUser(userID string) func(Event) bool {
+	return func(ev Event) bool {
+		_, actor := describe(ev)
+		return actor == userID
+	}
+}
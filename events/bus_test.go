@@ -0,0 +1,347 @@
+package events
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func TestBusBlock(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		bus := newTestBus()
+		sub := bus.Subscribe(SubscribeOptions{Policy: Block, Timeout: time.Second, Buffer: 1})
+		defer sub.Close()
+		other := bus.Subscribe(SubscribeOptions{Policy: Block, Buffer: 1})
+		defer other.Close()
+
+		bus.Publish(UserRegistered{UserID: "1"})
+		synctest.Wait()
+		<-other.Ch
+
+		// the channel is full, so the event waits in the queue for the
+		// timeout, without holding up the publisher or the other subscriber
+		t0 := time.Now()
+		bus.Publish(UserRegistered{UserID: "2"})
+		if waited := time.Since(t0); waited != 0 {
+			t.Fatalf("expected publish not to wait, waited %s", waited)
+		}
+		if got := (<-other.Ch).(UserRegistered).UserID; got != "2" || time.Since(t0) != 0 {
+			t.Fatalf("expected event 2 right away, got %s after %s", got, time.Since(t0))
+		}
+		synctest.Wait()
+		if sub.Dropped() != 0 {
+			t.Fatalf("expected the event to wait for the timeout")
+		}
+		time.Sleep(time.Second)
+		synctest.Wait()
+		if sub.Dropped() != 1 || bus.Stats().Dropped != 1 {
+			t.Fatalf("expected 1 dropped event, got %d (bus: %d)", sub.Dropped(), bus.Stats().Dropped)
+		}
+
+		// a subscriber that reads in time gets everything
+		bus.Publish(UserRegistered{UserID: "3"})
+		time.Sleep(500 * time.Millisecond)
+		<-sub.Ch
+		synctest.Wait()
+		if got := (<-sub.Ch).(UserRegistered).UserID; got != "3" {
+			t.Fatalf("expected event 3, got %s", got)
+		}
+		if sub.Dropped() != 1 {
+			t.Fatalf("expected still 1 dropped event, got %d", sub.Dropped())
+		}
+	})
+}
+
+// A stalled Block subscriber keeps no more than its buffer of events
+// waiting, on top of the channel.
+func TestBusBlockStalled(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		bus := newTestBus()
+		sub := bus.Subscribe(SubscribeOptions{Policy: Block, Timeout: time.Hour, Buffer: 2})
+		defer sub.Close()
+
+		for i := range 10 {
+			bus.Publish(UserRegistered{UserID: fmt.Sprint(i)})
+			synctest.Wait()
+		}
+		// two in the channel, one waiting in send, and two in the queue
+		info := bus.Subscriptions()[0]
+		if info.Queued > 2*info.Capacity {
+			t.Fatalf("expected at most %d events queued, got %d", 2*info.Capacity, info.Queued)
+		}
+		if sub.Dropped() != 5 {
+			t.Fatalf("expected 5 dropped events, got %d", sub.Dropped())
+		}
+
+		// those that were kept are delivered in order
+		var got []string
+		for range 5 {
+			got = append(got, (<-sub.Ch).(UserRegistered).UserID)
+			synctest.Wait()
+		}
+		if want := []string{"0", "1", "2", "3", "4"}; !slices.Equal(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	})
+}
+
+func TestBusDropOldest(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		bus := newTestBus()
+		sub := bus.Subscribe(SubscribeOptions{Policy: DropOldest, Buffer: 3})
+		defer sub.Close()
+
+		for _, id := range []string{"1", "2", "3", "4", "5"} {
+			bus.Publish(UserRegistered{UserID: id})
+		}
+		synctest.Wait()
+
+		var got []string
+		for range 3 {
+			got = append(got, (<-sub.Ch).(UserRegistered).UserID)
+		}
+		if got[0] != "3" || got[2] != "5" {
+			t.Fatalf("expected the three latest events, got %v", got)
+		}
+		if sub.Dropped() != 2 {
+			t.Fatalf("expected 2 dropped events, got %d", sub.Dropped())
+		}
+	})
+}
+
+func TestBusDisconnect(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		bus := newTestBus()
+		slow := bus.Subscribe(SubscribeOptions{Policy: Disconnect, Buffer: 1})
+		fast := bus.Subscribe(SubscribeOptions{Policy: Disconnect, Buffer: 1})
+		defer fast.Close()
+
+		for _, id := range []string{"1", "2"} {
+			bus.Publish(UserRegistered{UserID: id})
+			synctest.Wait()
+			<-fast.Ch
+		}
+
+		if _, ok := <-slow.Ch; !ok {
+			t.Fatalf("expected the queued event before the channel is closed")
+		}
+		if _, ok := <-slow.Ch; ok {
+			t.Fatalf("expected the slow subscriber to be disconnected")
+		}
+		if got := bus.Stats().Disconnected; got != 1 {
+			t.Fatalf("expected 1 disconnect, got %d", got)
+		}
+
+		// publishing to a disconnected subscriber is a no-op
+		bus.Publish(UserRegistered{UserID: "3"})
+		if got := (<-fast.Ch).(UserRegistered).UserID; got != "3" {
+			t.Fatalf("expected event 3, got %s", got)
+		}
+	})
+}
+
+// A subscriber that publishes while handling an event used to deadlock the
+// bus once its queue filled up.
+func TestBusPublishFromSubscriber(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		bus := newTestBus()
+		sub := bus.Subscribe(SubscribeOptions{Policy: Block, Timeout: time.Second, Buffer: 1})
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for ev := range sub.Ch {
+				if ev, ok := ev.(UserRegistered); ok {
+					bus.Publish(CartUpdated{CartID: ev.UserID})
+					bus.Publish(CartUpdated{CartID: ev.UserID})
+				}
+			}
+		}()
+		for _, id := range []string{"1", "2", "3"} {
+			bus.Publish(UserRegistered{UserID: id})
+		}
+		sub.Close()
+		<-done
+	})
+}
+
+func TestBusConcurrent(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		bus := newTestBus()
+
+		var (
+			readers, publishers sync.WaitGroup
+			subs                []*subscriber[Event]
+		)
+		for _, policy := range []Policy{Block, DropOldest, Disconnect} {
+			for range 3 {
+				sub := bus.Subscribe(SubscribeOptions{Policy: policy, Buffer: 2, Timeout: time.Millisecond})
+				subs = append(subs, sub)
+				readers.Go(func() {
+					for range sub.Ch {
+						time.Sleep(time.Millisecond)
+					}
+				})
+			}
+		}
+		for range 5 {
+			publishers.Go(func() {
+				for range 50 {
+					bus.Publish(UserRegistered{})
+				}
+			})
+		}
+		publishers.Wait()
+		for _, sub := range subs {
+			sub.Close()
+		}
+		readers.Wait()
+
+		stats := bus.Stats()
+		if stats.Published != 250 {
+			t.Fatalf("expected 250 published events, got %d", stats.Published)
+		}
+		if stats.Dropped == 0 || stats.Disconnected == 0 {
+			t.Fatalf("expected slow subscribers to drop events and disconnect: %+v", stats)
+		}
+	})
+}
+
+func TestBusSubscribeTo(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		bus := newTestBus()
+		sub := SubscribeTo[CartUpdated](bus, SubscribeOptions{Filter: ForCart("cart1")})
+		defer sub.Close()
+
+		bus.Publish(UserRegistered{UserID: "alice"})
+		bus.Publish(CartCreated{CartID: "cart1"})
+		bus.Publish(CartUpdated{CartID: "cart2", ItemIDs: []string{"bread"}})
+		bus.Publish(CartUpdated{CartID: "cart1", ItemIDs: []string{"milk"}})
+		synctest.Wait()
+
+		if got := (<-sub.Ch).ItemIDs; !slices.Equal(got, []string{"milk"}) {
+			t.Fatalf("expected the milk update only, got %v", got)
+		}
+		select {
+		case ev := <-sub.Ch:
+			t.Fatalf("unexpected event %+v", ev)
+		default:
+		}
+	})
+}
+
+func TestBusForUser(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		bus := newTestBus()
+		sub := bus.Subscribe(SubscribeOptions{Filter: ForUser("alice")})
+		defer sub.Close()
+
+		bus.Publish(CartUpdated{CartID: "cart1", Actor: "bob"})
+		bus.Publish(CartSwitched{UserID: "alice", CartID: "cart1"})
+		bus.Publish(CartCreated{CartID: "cart2", Actor: "alice"})
+		synctest.Wait()
+
+		for _, want := range []string{"CartSwitched", "CartCreated"} {
+			if got := typeName(<-sub.Ch); got != want {
+				t.Fatalf("expected %s, got %s", want, got)
+			}
+		}
+		if len(sub.Ch) != 0 {
+			t.Fatalf("expected no more events, got %d", len(sub.Ch))
+		}
+	})
+}
+
+func TestBusUnsubscribe(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		bus := newTestBus()
+		a := bus.Subscribe()
+		b := SubscribeTo[CartUpdated](bus)
+		slow := bus.Subscribe(SubscribeOptions{Policy: Disconnect, Buffer: 1})
+		if got := bus.Subscribers(); got != 3 {
+			t.Fatalf("expected 3 subscribers, got %d", got)
+		}
+
+		a.Close()
+		a.Close() // closing twice is fine
+		if got := bus.Subscribers(); got != 2 {
+			t.Fatalf("expected 2 subscribers, got %d", got)
+		}
+
+		// disconnected subscribers are removed too
+		bus.Publish(UserRegistered{})
+		bus.Publish(UserRegistered{})
+		synctest.Wait()
+		if got := bus.Subscribers(); got != 1 {
+			t.Fatalf("expected 1 subscriber, got %d", got)
+		}
+		for range slow.Ch {
+		}
+
+		b.Close()
+		if got := bus.Subscribers(); got != 0 {
+			t.Fatalf("expected no subscribers, got %d", got)
+		}
+	})
+}
+
+func TestBusTrace(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		bus := newTestBus()
+		all := bus.Subscribe(SubscribeOptions{Name: "all", Buffer: 5})
+		defer all.Close()
+		carts := SubscribeTo[CartUpdated](bus, SubscribeOptions{Name: "carts", Policy: DropOldest})
+		defer carts.Close()
+		trace := bus.Trace(1)
+		defer trace.Close()
+
+		bus.Publish(UserRegistered{UserID: "alice"})
+		bus.Publish(CartUpdated{CartID: "cart"})
+		synctest.Wait()
+
+		// the first trace made room for the second
+		got := <-trace.Ch
+		if got.Type != "CartUpdated" || got.Subscribers != 2 {
+			t.Fatalf("unexpected trace: %+v", got)
+		}
+		if bus.Stats().Dropped != 0 {
+			t.Fatalf("dropped traces must not count as dropped events")
+		}
+
+		infos := bus.Subscriptions()
+		if len(infos) != 2 {
+			t.Fatalf("expected 2 subscriptions, got %+v", infos)
+		}
+		if infos[0].Name != "all" || infos[0].Queued != 2 || infos[0].Capacity != 5 {
+			t.Fatalf("unexpected info: %+v", infos[0])
+		}
+		if infos[1].Name != "carts" || infos[1].Queued != 1 || infos[1].Policy != DropOldest {
+			t.Fatalf("unexpected info: %+v", infos[1])
+		}
+	})
+}
+
+// receive returns the next n events of the subscription, and fails the test
+// if they don't come in time.
+func receive[T any](t *testing.T, sub *subscriber[T], n int) []T {
+	t.Helper()
+	var got []T
+	for range n {
+		select {
+		case ev := <-sub.Ch:
+			got = append(got, ev)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for event %d of %d", len(got)+1, n)
+		}
+	}
+	return got
+}
+
+func newTestBus() *Bus {
+	return NewBus(slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
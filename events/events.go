@@ -1,16 +1,152 @@
 package events
 
+import (
+	"time"
+
+	"github.com/kvalv/shoplist/stores"
+)
+
+// Events that change a cart say who did it (Actor, a user ID, empty when
+// done by the system) and when.
 type (
 	Event interface {
 		IsEvent()
 	}
 
+	ItemAdded struct {
+		CartID string
+		ItemID string
+		Text   string
+		Actor  string
+		At     time.Time
+	}
+	ItemChecked struct {
+		CartID string
+		ItemID string
+		Actor  string
+		At     time.Time
+	}
+	ItemUnchecked struct {
+		CartID string
+		ItemID string
+		Actor  string
+		At     time.Time
+	}
+	ItemRemoved struct {
+		CartID string
+		ItemID string
+		Actor  string
+		At     time.Time
+	}
+	// ItemEnrichmentRequested is when someone asks for an item to be looked
+	// up again, by another phrase if Query is set.
+	ItemEnrichmentRequested struct {
+		CartID string
+		ItemID string
+		Query  string
+		Actor  string
+		At     time.Time
+	}
+	// ItemEnrichmentStarted is when the worker starts looking up an item.
+	ItemEnrichmentStarted struct {
+		CartID  string
+		ItemID  string
+		Attempt int
+		Actor   string
+		At      time.Time
+	}
+	// ItemEnriched is when the worker has found candidates for an item, or
+	// found that there are none.
+	ItemEnriched struct {
+		CartID     string
+		ItemID     string
+		Candidates int
+		Actor      string
+		At         time.Time
+	}
+	// ItemEnrichmentFailed is when the worker has given up finding
+	// candidates for an item.
+	ItemEnrichmentFailed struct {
+		CartID   string
+		ItemID   string
+		Attempts int
+		Error    string
+		Actor    string
+		At       time.Time
+	}
+	// CandidateChosen is when someone picks another of the candidates found
+	// for an item.
+	CandidateChosen struct {
+		CartID    string
+		ItemID    string
+		Candidate int // index into the candidates
+		Name      string
+		Actor     string
+		At        time.Time
+	}
+	// StockRefreshRequested is when someone, or the cron job, asks for the
+	// stock of the chosen candidates in a cart to be looked up again.
+	StockRefreshRequested struct {
+		CartID string
+		Actor  string
+		At     time.Time
+	}
+	// ItemStockChanged is when a refresh found the chosen candidate of an
+	// item to have another stock, or to be somewhere else in the store.
+	ItemStockChanged struct {
+		CartID string
+		ItemID string
+		Stock  int
+		Actor  string
+		At     time.Time
+	}
+	CartRenamed struct {
+		CartID string
+		Name   string
+		Actor  string
+		At     time.Time
+	}
+	TargetStoreChanged struct {
+		CartID string
+		Store  stores.Store
+		Actor  string
+		At     time.Time
+	}
+	// ShopChanged is when someone picks which of the shops of the target
+	// store a cart is for.
+	ShopChanged struct {
+		CartID string
+		ShopID string
+		Actor  string
+		At     time.Time
+	}
+	// AreaOrderChanged is when someone sets the order to walk the areas of
+	// the shop of a cart in. It applies to every cart for that shop.
+	AreaOrderChanged struct {
+		CartID string
+		ShopID string
+		Areas  []string
+		Actor  string
+		At     time.Time
+	}
+	CollaboratorAdded struct {
+		CartID string
+		UserID string // the new collaborator
+		Actor  string
+		At     time.Time
+	}
+
+	// CartUpdated tells that something in a cart changed, for those who only
+	// need to know that, like renderers. It is derived from the events above
+	// (see [Notification]), and not logged anymore, but older logs have it.
 	CartUpdated struct {
 		CartID  string
 		ItemIDs []string
+		Actor   string // user ID, empty when done by the system
 	}
 	CartCreated struct {
 		CartID string
+		Actor  string
 	}
 	CartSwitched struct {
 		UserID string
@@ -22,7 +158,139 @@ type (
 	}
 )
 
-func (CartUpdated) IsEvent()    {}
-func (CartCreated) IsEvent()    {}
-func (CartSwitched) IsEvent()   {}
-func (UserRegistered) IsEvent() {}
+func (ItemAdded) IsEvent()               {}
+func (ItemChecked) IsEvent()             {}
+func (ItemUnchecked) IsEvent()           {}
+func (ItemRemoved) IsEvent()             {}
+func (ItemEnrichmentRequested) IsEvent() {}
+func (ItemEnrichmentStarted) IsEvent()   {}
+func (ItemEnriched) IsEvent()            {}
+func (ItemEnrichmentFailed) IsEvent()    {}
+func (CandidateChosen) IsEvent()         {}
+func (StockRefreshRequested) IsEvent()   {}
+func (ItemStockChanged) IsEvent()        {}
+func (CartRenamed) IsEvent()             {}
+func (TargetStoreChanged) IsEvent()      {}
+func (ShopChanged) IsEvent()             {}
+func (AreaOrderChanged) IsEvent()        {}
+func (CollaboratorAdded) IsEvent()       {}
+func (CartUpdated) IsEvent()             {}
+func (CartCreated) IsEvent()             {}
+func (CartSwitched) IsEvent()            {}
+func (UserRegistered) IsEvent()          {}
+
+func init() {
+	register[ItemAdded]()
+	register[ItemChecked]()
+	register[ItemUnchecked]()
+	register[ItemRemoved]()
+	register[ItemEnrichmentRequested]()
+	register[ItemEnrichmentStarted]()
+	register[ItemEnriched]()
+	register[ItemEnrichmentFailed]()
+	register[CandidateChosen]()
+	register[StockRefreshRequested]()
+	register[ItemStockChanged]()
+	register[CartRenamed]()
+	register[TargetStoreChanged]()
+	register[ShopChanged]()
+	register[AreaOrderChanged]()
+	register[CollaboratorAdded]()
+	register[CartUpdated]()
+	register[CartCreated]()
+	register[CartSwitched]()
+	register[UserRegistered]()
+}
+
+// describe returns the cart and the user an event concerns, either of which
+// may be empty.
+func describe(ev Event) (cartID, actor string) {
+	switch ev := ev.(type) {
+	case ItemAdded:
+		return ev.CartID, ev.Actor
+	case ItemChecked:
+		return ev.CartID, ev.Actor
+	case ItemUnchecked:
+		return ev.CartID, ev.Actor
+	case ItemRemoved:
+		return ev.CartID, ev.Actor
+	case ItemEnrichmentRequested:
+		return ev.CartID, ev.Actor
+	case ItemEnrichmentStarted:
+		return ev.CartID, ev.Actor
+	case ItemEnriched:
+		return ev.CartID, ev.Actor
+	case ItemEnrichmentFailed:
+		return ev.CartID, ev.Actor
+	case CandidateChosen:
+		return ev.CartID, ev.Actor
+	case StockRefreshRequested:
+		return ev.CartID, ev.Actor
+	case ItemStockChanged:
+		return ev.CartID, ev.Actor
+	case CartRenamed:
+		return ev.CartID, ev.Actor
+	case TargetStoreChanged:
+		return ev.CartID, ev.Actor
+	case ShopChanged:
+		return ev.CartID, ev.Actor
+	case AreaOrderChanged:
+		return ev.CartID, ev.Actor
+	case CollaboratorAdded:
+		return ev.CartID, ev.Actor
+	case CartUpdated:
+		return ev.CartID, ev.Actor
+	case CartCreated:
+		return ev.CartID, ev.Actor
+	case CartSwitched:
+		return ev.CartID, ev.UserID
+	case UserRegistered:
+		return "", ev.UserID
+	}
+	return "", ""
+}
+
+// itemOf returns the item an event is about, if any.
+func itemOf(ev Event) string {
+	switch ev := ev.(type) {
+	case ItemAdded:
+		return ev.ItemID
+	case ItemChecked:
+		return ev.ItemID
+	case ItemUnchecked:
+		return ev.ItemID
+	case ItemRemoved:
+		return ev.ItemID
+	case ItemEnrichmentRequested:
+		return ev.ItemID
+	case ItemEnrichmentStarted:
+		return ev.ItemID
+	case ItemEnriched:
+		return ev.ItemID
+	case ItemEnrichmentFailed:
+		return ev.ItemID
+	case CandidateChosen:
+		return ev.ItemID
+	case ItemStockChanged:
+		return ev.ItemID
+	}
+	return ""
+}
+
+// Notification returns the CartUpdated derived from an event that changes a
+// cart. It returns false for other events.
+func Notification(ev Event) (CartUpdated, bool) {
+	switch ev.(type) {
+	case ItemAdded, ItemChecked, ItemUnchecked, ItemRemoved,
+		ItemEnrichmentRequested, ItemEnrichmentStarted, ItemEnriched, ItemEnrichmentFailed,
+		CandidateChosen, ItemStockChanged, CartRenamed, TargetStoreChanged, ShopChanged, AreaOrderChanged, CollaboratorAdded:
+	default:
+		return CartUpdated{}, false
+	}
+	cartID, actor := describe(ev)
+	u := CartUpdated{CartID: cartID, Actor: actor}
+	if ID := itemOf(ev); ID != "" {
+		u.ItemIDs = []string{ID}
+	}
+	return u, true
+}
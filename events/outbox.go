@@ -0,0 +1,557 @@
+package events
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kvalv/shoplist/dialect"
+)
+
+// Handler processes an event for a durable consumer. A returned error means
+// the event is delivered again later.
+type Handler func(ctx context.Context, rec Record) error
+
+// ConsumeOptions decides how events are handed to a consumer, and how often
+// a failing delivery is retried.
+type ConsumeOptions struct {
+	MaxAttempts int           // defaults to 5; the delivery is dead after that
+	Backoff     time.Duration // wait before the first retry, doubled for each after; defaults to one second
+	Concurrency int           // events handled at the same time; defaults to 1
+	Lease       time.Duration // how long an instance has to handle an event it claimed, before it's tried again; defaults to a minute
+
+	// OnDead, if set, is called when the consumer is given up on for an
+	// event, with the error of the last attempt.
+	OnDead func(rec Record, attempts int, err error)
+}
+
+// The Outbox dispatches the events in the event log, once they are committed.
+//
+// State changes stage their events in the same transaction (see [Stage]), so
+// an event is never lost between saving and handling it, not even across a
+// restart. The dispatcher then
+//
+//   - publishes new events on the bus, for subscribers that only care about
+//     the here and now, like renderers. Events that change a cart are
+//     followed by their CartUpdated, see [Notification]. And it
+//   - delivers every event at least once to each durable consumer, such as the
+//     worker or a webhook. A consumer keeps its position in the log, and failed
+//     deliveries are retried with backoff until they are dead.
+//
+// The bus and each consumer are dispatched to by a loop of their own, so a
+// slow consumer holds up neither the bus nor the other consumers.
+//
+// Several instances can share the database. An instance claims the events
+// before it hands them to a consumer, so each is handled by one of them,
+// unless it fails to within the lease (see [ConsumeOptions]) and is tried
+// again. The bus is published to by one of them too, so a bus that should
+// reach every instance needs a [Transport].
+type Outbox struct {
+	db        *sql.DB
+	dialect   dialect.Dialect
+	bus       *Bus
+	log       *slog.Logger
+	consumers []*consumer
+	kick      chan struct{} // wakes up the relay to the bus
+	poll      time.Duration
+	now       func() time.Time
+}
+
+// relay is the consumer name under which the position of the bus is kept.
+const relay = "bus"
+
+type consumer struct {
+	name   string
+	handle Handler
+	opts   ConsumeOptions
+	kick   chan struct{}
+}
+
+// NewOutbox dispatches the events table of db. The bus gets the events
+// committed from the first time it's connected on; bus may be nil.
+func NewOutbox(db *sql.DB, bus *Bus, log *slog.Logger) (*Outbox, error) {
+	o := &Outbox{
+		db:      db,
+		dialect: dialect.Of(db),
+		bus:     bus,
+		log:     log,
+		kick:    make(chan struct{}, 1),
+		poll:    time.Second,
+		now:     time.Now,
+	}
+	if bus != nil {
+		if err := o.register(relay); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// WithPollInterval sets how often the log is checked for events that were
+// committed without a call to Notify, e.g. by another process.
+func (o *Outbox) WithPollInterval(d time.Duration) *Outbox {
+	o.poll = d
+	return o
+}
+
+// Consume registers a durable consumer. A new consumer starts at the end of
+// the log; a known one continues where it left off.
+func (o *Outbox) Consume(name string, handle Handler, opts ...ConsumeOptions) error {
+	var opt ConsumeOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if opt.MaxAttempts <= 0 {
+		opt.MaxAttempts = 5
+	}
+	if opt.Backoff <= 0 {
+		opt.Backoff = time.Second
+	}
+	if opt.Concurrency <= 0 {
+		opt.Concurrency = 1
+	}
+	if opt.Lease <= 0 {
+		opt.Lease = time.Minute
+	}
+	if name == relay {
+		return fmt.Errorf("consumer name %q is taken by the bus", name)
+	}
+
+	if err := o.register(name); err != nil {
+		return err
+	}
+	o.consumers = append(o.consumers, &consumer{name: name, handle: handle, opts: opt, kick: make(chan struct{}, 1)})
+	return nil
+}
+
+// register puts a new consumer at the end of the log.
+func (o *Outbox) register(name string) error {
+	// 'where true' keeps sqlite from reading 'on conflict' as a join
+	_, err := o.db.Exec(o.dialect.Rebind(`
+		insert into outbox_consumers(name, position)
+		select ?, coalesce(max(id), 0) from events where true
+		on conflict(name) do nothing;
+	`), name)
+	if err != nil {
+		return fmt.Errorf("sql: %w", err)
+	}
+	return nil
+}
+
+// position returns where the consumer is in the log.
+func (o *Outbox) position(name string) (int64, error) {
+	var position int64
+	if err := o.db.QueryRow(o.dialect.Rebind(`select position from outbox_consumers where name = ?`), name).Scan(&position); err != nil {
+		return 0, fmt.Errorf("sql: %w", err)
+	}
+	return position, nil
+}
+
+// advance moves the consumer from one position to another. It returns false
+// if the consumer was not at from, because another instance moved it.
+func (o *Outbox) advance(name string, from, to int64) (bool, error) {
+	return advance(o.db, o.dialect, name, from, to)
+}
+
+func advance(db interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}, d dialect.Dialect, name string, from, to int64) (bool, error) {
+	res, err := db.Exec(d.Rebind(`
+		update outbox_consumers set position = ?
+		where name = ? and position = ?;
+	`), to, name, from)
+	if err != nil {
+		return false, fmt.Errorf("sql: %w", err)
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Publish logs an event that doesn't come with a state change, and
+// dispatches it.
+func (o *Outbox) Publish(ev Event) error {
+	if _, err := appendTo(o.db, o.dialect, ev); err != nil {
+		return err
+	}
+	o.Notify()
+	return nil
+}
+
+// Notify wakes up the dispatcher, after a transaction with staged events has
+// been committed.
+func (o *Outbox) Notify() {
+	wake(o.kick)
+	for _, c := range o.consumers {
+		wake(c.kick)
+	}
+}
+
+func wake(kick chan struct{}) {
+	select {
+	case kick <- struct{}{}:
+	default:
+	}
+}
+
+// Run dispatches events until the context is cancelled, with a loop for the
+// bus and one for each consumer.
+func (o *Outbox) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	if o.bus != nil {
+		wg.Go(func() { o.loop(ctx, relay, o.kick, o.relay) })
+	}
+	for _, c := range o.consumers {
+		wg.Go(func() {
+			o.loop(ctx, c.name, c.kick, func() error { return o.dispatch(ctx, c) })
+		})
+	}
+	wg.Wait()
+}
+
+// loop calls pass whenever it's kicked or the poll interval has passed,
+// until the context is cancelled.
+func (o *Outbox) loop(ctx context.Context, name string, kick <-chan struct{}, pass func() error) {
+	ticker := time.NewTicker(o.poll)
+	defer ticker.Stop()
+	for {
+		if err := pass(); err != nil {
+			o.log.Error("dispatch failed", "consumer", name, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-kick:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Dispatch does a single pass: new events are published on the bus, and
+// handed to the consumers together with the retries that are due.
+func (o *Outbox) Dispatch(ctx context.Context) error {
+	var errs []error
+	if err := o.relay(); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", relay, err))
+	}
+	for _, c := range o.consumers {
+		if err := o.dispatch(ctx, c); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// dispatch hands the consumer its retries that are due, and the new events.
+func (o *Outbox) dispatch(ctx context.Context, c *consumer) error {
+	return errors.Join(o.retry(ctx, c), o.deliver(ctx, c))
+}
+
+// relay publishes the new events on the bus. They are claimed first, so
+// that only one instance publishes them; the bus is for the here and now,
+// and an event lost to a crash in between is no big deal.
+func (o *Outbox) relay() error {
+	if o.bus == nil {
+		return nil
+	}
+	position, err := o.position(relay)
+	if err != nil {
+		return err
+	}
+	recs, err := o.after(position)
+	if err != nil || len(recs) == 0 {
+		return err
+	}
+	if claimed, err := o.advance(relay, position, recs[len(recs)-1].ID); err != nil || !claimed {
+		return err
+	}
+	for _, rec := range recs {
+		o.bus.Publish(rec.Event)
+		if u, ok := Notification(rec.Event); ok {
+			o.bus.Publish(u)
+		}
+	}
+	return nil
+}
+
+// deliver hands the consumer the events after its position, as many at a
+// time as its concurrency allows. Each such chunk is claimed before it is
+// handled, see [Outbox.claim]. Failures are set aside for retry, and don't
+// hold up the rest. When another instance has claimed a chunk first, it is
+// left to carry on.
+func (o *Outbox) deliver(ctx context.Context, c *consumer) error {
+	position, err := o.position(c.name)
+	if err != nil {
+		return err
+	}
+	recs, err := o.after(position)
+	if err != nil {
+		return err
+	}
+	for chunk := range slices.Chunk(recs, c.opts.Concurrency) {
+		last := chunk[len(chunk)-1].ID
+		claimed, err := o.claim(c, position, last, chunk)
+		if err != nil || !claimed {
+			return err
+		}
+		position = last
+		err = each(c, chunk, func(rec Record) error {
+			return o.handle(ctx, c, rec, 1)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claim moves the consumer past the chunk, and records a delivery for each
+// event in it, due when the lease runs out. A crash before they are handled
+// leaves them to be retried, instead of lost. It returns false if another
+// instance moved the consumer first.
+func (o *Outbox) claim(c *consumer, from, to int64, chunk []Record) (bool, error) {
+	tx, err := o.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("sql: %w", err)
+	}
+	defer tx.Rollback()
+
+	if advanced, err := advance(tx, o.dialect, c.name, from, to); err != nil || !advanced {
+		return false, err
+	}
+	next := o.now().Add(c.opts.Lease)
+	for _, rec := range chunk {
+		_, err := tx.Exec(o.dialect.Rebind(`
+			insert into outbox_deliveries(consumer, event_id, attempts, last_error, next_attempt_at, dead)
+			values (?, ?, 1, '', ?, false);
+		`), c.name, rec.ID, next)
+		if err != nil {
+			return false, fmt.Errorf("sql: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("sql: %w", err)
+	}
+	return true, nil
+}
+
+// retry hands the consumer the failed events whose backoff has passed. Each
+// is claimed first, by counting the attempt and pushing the next one back by
+// the lease, so that only one instance retries it.
+func (o *Outbox) retry(ctx context.Context, c *consumer) error {
+	pending, err := o.deliveries(`where consumer = ? and not dead`, c.name)
+	if err != nil {
+		return err
+	}
+	var due []Delivery
+	for _, d := range pending {
+		if !d.NextAttempt.After(o.now()) {
+			due = append(due, d)
+		}
+	}
+	return each(c, due, func(d Delivery) error {
+		res, err := o.db.Exec(o.dialect.Rebind(`
+			update outbox_deliveries set attempts = ?, next_attempt_at = ?
+			where consumer = ? and event_id = ? and attempts = ? and not dead;
+		`), d.Attempts+1, o.now().Add(c.opts.Lease), c.name, d.Record.ID, d.Attempts)
+		if err != nil {
+			return fmt.Errorf("sql: %w", err)
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return err // claimed by another instance
+		}
+		return o.handle(ctx, c, d.Record, d.Attempts+1)
+	})
+}
+
+// handle hands a claimed event to the consumer. The delivery is done with if
+// it succeeds, and set aside for retry if not.
+func (o *Outbox) handle(ctx context.Context, c *consumer, rec Record, attempt int) error {
+	if err := c.handle(ctx, rec); err != nil {
+		o.log.Warn("delivery failed", "consumer", c.name, "event", rec.ID, "type", rec.Type, "attempt", attempt, "error", err)
+		return o.fail(c, rec, attempt, err)
+	}
+	if _, err := o.db.Exec(o.dialect.Rebind(`delete from outbox_deliveries where consumer = ? and event_id = ?`), c.name, rec.ID); err != nil {
+		return fmt.Errorf("sql: %w", err)
+	}
+	return nil
+}
+
+// each calls fn for every item, as many at a time as the concurrency of the
+// consumer allows, and waits for them all.
+func each[T any](c *consumer, items []T, fn func(T) error) error {
+	var (
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, c.opts.Concurrency)
+		errs = make([]error, len(items))
+	)
+	for i, item := range items {
+		sem <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			errs[i] = fn(item)
+		})
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// fail records a failed attempt, and gives up on the delivery once it has
+// been tried too many times.
+func (o *Outbox) fail(c *consumer, rec Record, attempts int, cause error) error {
+	dead := attempts >= c.opts.MaxAttempts
+	next := o.now().Add(c.opts.Backoff << (attempts - 1))
+	_, err := o.db.Exec(o.dialect.Rebind(`
+		insert into outbox_deliveries(consumer, event_id, attempts, last_error, next_attempt_at, dead)
+		values (?, ?, ?, ?, ?, ?)
+		on conflict(consumer, event_id) do update set
+			attempts = excluded.attempts,
+			last_error = excluded.last_error,
+			next_attempt_at = excluded.next_attempt_at,
+			dead = excluded.dead;
+	`), c.name, rec.ID, attempts, cause.Error(), next, dead)
+	if err != nil {
+		return fmt.Errorf("sql: %w", err)
+	}
+	if dead {
+		o.log.Error("delivery is dead", "consumer", c.name, "event", rec.ID, "attempts", attempts)
+		if c.opts.OnDead != nil {
+			c.opts.OnDead(rec, attempts, cause)
+		}
+	}
+	return nil
+}
+
+// after returns the events after the given ID, oldest first. Events are
+// committed in the order of their IDs, see [Stage], so moving past the last
+// one returned never skips one committed later.
+func (o *Outbox) after(ID int64) ([]Record, error) {
+	rows, err := o.db.Query(o.dialect.Rebind(`
+		select id, type, cart_id, actor, created_at, payload
+		from events
+		where id > ?
+		order by id
+		limit 100;
+	`), ID)
+	if err != nil {
+		return nil, fmt.Errorf("sql: %w", err)
+	}
+	defer rows.Close()
+
+	var res []Record
+	for rows.Next() {
+		rec, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, rec)
+	}
+	return res, rows.Err()
+}
+
+// Delivery is an event a consumer failed to handle.
+type Delivery struct {
+	Consumer    string
+	Record      Record
+	Attempts    int
+	LastError   string
+	NextAttempt time.Time
+	Dead        bool // no more retries
+}
+
+// ConsumerStatus tells how far a consumer has come.
+type ConsumerStatus struct {
+	Name     string
+	Position int64 // last event handed to the consumer
+	Pending  int   // deliveries being handled, or failed and waiting for a retry
+	Dead     int
+}
+
+// Consumers returns the status of every consumer that has been registered,
+// by this process or an earlier one.
+func (o *Outbox) Consumers() ([]ConsumerStatus, error) {
+	rows, err := o.db.Query(`
+		select c.name, c.position,
+			coalesce(sum(case when not d.dead then 1 else 0 end), 0),
+			coalesce(sum(case when d.dead then 1 else 0 end), 0)
+		from outbox_consumers c
+		left join outbox_deliveries d on d.consumer = c.name
+		group by c.name, c.position
+		order by c.name;
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("sql: %w", err)
+	}
+	defer rows.Close()
+
+	var res []ConsumerStatus
+	for rows.Next() {
+		var s ConsumerStatus
+		if err := rows.Scan(&s.Name, &s.Position, &s.Pending, &s.Dead); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		res = append(res, s)
+	}
+	return res, rows.Err()
+}
+
+// DeadLetters returns the deliveries that were given up on, newest first.
+func (o *Outbox) DeadLetters() ([]Delivery, error) {
+	return o.deliveries(`where dead order by e.id desc`)
+}
+
+// Retry revives a dead delivery, which is then tried again on the next
+// dispatch with a fresh set of attempts.
+func (o *Outbox) Retry(consumer string, eventID int64) error {
+	res, err := o.db.Exec(o.dialect.Rebind(`
+		update outbox_deliveries
+		set attempts = 0, dead = false, next_attempt_at = ?
+		where consumer = ? and event_id = ? and dead;
+	`), o.now(), consumer, eventID)
+	if err != nil {
+		return fmt.Errorf("sql: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no dead delivery of event %d to %s", eventID, consumer)
+	}
+	o.Notify()
+	return nil
+}
+
+func (o *Outbox) deliveries(where string, args ...any) ([]Delivery, error) {
+	rows, err := o.db.Query(o.dialect.Rebind(`
+		select d.consumer, d.attempts, d.last_error, d.next_attempt_at, d.dead,
+			e.id, e.type, e.cart_id, e.actor, e.created_at, e.payload
+		from outbox_deliveries d
+		join events e on e.id = d.event_id
+		`+where), args...)
+	if err != nil {
+		return nil, fmt.Errorf("sql: %w", err)
+	}
+	defer rows.Close()
+
+	var res []Delivery
+	for rows.Next() {
+		var (
+			d             Delivery
+			cartID, actor sql.NullString
+			payload       []byte
+		)
+		err := rows.Scan(&d.Consumer, &d.Attempts, &d.LastError, &d.NextAttempt, &d.Dead,
+			&d.Record.ID, &d.Record.Type, &cartID, &actor, &d.Record.At, &payload)
+		if err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		d.Record.CartID, d.Record.Actor = cartID.String, actor.String
+		d.Record.Payload = payload
+		if d.Record.Event, err = Decode(d.Record.Type, payload); err != nil {
+			return nil, fmt.Errorf("record %d: %w", d.Record.ID, err)
+		}
+		res = append(res, d)
+	}
+	return res, rows.Err()
+}
@@ -0,0 +1,361 @@
+package events
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kvalv/shoplist/dialect"
+)
+
+func TestOutbox(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	// events from before the consumer existed are not its business
+	if _, err := NewSqlStore(db).Append(UserRegistered{UserID: "old"}); err != nil {
+		t.Fatalf("Append() error: %v", err)
+	}
+
+	bus := newTestBus()
+	sub := bus.Subscribe()
+	defer sub.Close()
+	outbox := newTestOutbox(t, db, bus)
+	var got []string
+	consume(t, outbox, "test", func(ctx context.Context, rec Record) error {
+		got = append(got, rec.Event.(UserRegistered).UserID)
+		return nil
+	})
+
+	// a rolled back change takes its events with it
+	stage(t, db, false, UserRegistered{UserID: "rolled back"})
+	stage(t, db, true, UserRegistered{UserID: "alice"})
+	if err := outbox.Publish(UserRegistered{UserID: "bob"}); err != nil {
+		t.Fatalf("Publish() error: %v", err)
+	}
+	if err := outbox.Dispatch(ctx); err != nil {
+		t.Fatalf("Dispatch() error: %v", err)
+	}
+	if want := []string{"alice", "bob"}; !slices.Equal(got, want) {
+		t.Fatalf("consumer got %v, want %v", got, want)
+	}
+	receive(t, sub, 2)
+
+	// nothing is delivered twice
+	if err := outbox.Dispatch(ctx); err != nil {
+		t.Fatalf("Dispatch() error: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(got) != 2 || len(sub.Ch) != 0 {
+		t.Fatalf("expected no redelivery, got %v and %d on the bus", got, len(sub.Ch))
+	}
+
+	// a restarted consumer continues where it left off
+	stage(t, db, true, UserRegistered{UserID: "carol"})
+	restarted := newTestOutbox(t, db, nil)
+	consume(t, restarted, "test", func(ctx context.Context, rec Record) error {
+		got = append(got, rec.Event.(UserRegistered).UserID)
+		return nil
+	})
+	if err := restarted.Dispatch(ctx); err != nil {
+		t.Fatalf("Dispatch() error: %v", err)
+	}
+	if want := []string{"alice", "bob", "carol"}; !slices.Equal(got, want) {
+		t.Fatalf("consumer got %v, want %v", got, want)
+	}
+}
+
+func TestOutboxRetry(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	outbox := newTestOutbox(t, db, nil)
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	outbox.now = func() time.Time { return now }
+
+	var attempts int
+	var gaveUp []int
+	err := outbox.Consume("flaky", func(ctx context.Context, rec Record) error {
+		attempts++
+		return errors.New("unavailable")
+	}, ConsumeOptions{MaxAttempts: 3, Backoff: time.Minute, OnDead: func(rec Record, attempts int, err error) {
+		gaveUp = append(gaveUp, attempts)
+	}})
+	if err != nil {
+		t.Fatalf("Consume() error: %v", err)
+	}
+	var healthy int
+	consume(t, outbox, "healthy", func(ctx context.Context, rec Record) error {
+		healthy++
+		return nil
+	})
+
+	stage(t, db, true, CartCreated{CartID: "cart"})
+	stage(t, db, true, CartCreated{CartID: "cart"})
+
+	// Dispatch after each step of the backoff: 1m, then 2m
+	for _, step := range []time.Duration{0, 30 * time.Second, 30 * time.Second, time.Minute, time.Minute} {
+		now = now.Add(step)
+		if err := outbox.Dispatch(ctx); err != nil {
+			t.Fatalf("Dispatch() error: %v", err)
+		}
+	}
+	if attempts != 6 {
+		t.Fatalf("expected 3 attempts for each event, got %d", attempts)
+	}
+	if healthy != 2 {
+		t.Fatalf("a failing consumer must not hold up the others, got %d events", healthy)
+	}
+
+	dead, err := outbox.DeadLetters()
+	if err != nil {
+		t.Fatalf("DeadLetters() error: %v", err)
+	}
+	if len(dead) != 2 || dead[0].LastError != "unavailable" || dead[0].Attempts != 3 {
+		t.Fatalf("unexpected dead letters: %+v", dead)
+	}
+	if !slices.Equal(gaveUp, []int{3, 3}) {
+		t.Fatalf("expected OnDead for each dead delivery, got %v", gaveUp)
+	}
+	status, err := outbox.Consumers()
+	if err != nil {
+		t.Fatalf("Consumers() error: %v", err)
+	}
+	if status[0].Name != "flaky" || status[0].Dead != 2 || status[1].Dead != 0 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	// dead deliveries stay dead, until revived
+	now = now.Add(time.Hour)
+	if err := outbox.Dispatch(ctx); err != nil {
+		t.Fatalf("Dispatch() error: %v", err)
+	}
+	if attempts != 6 {
+		t.Fatalf("expected no more attempts, got %d", attempts)
+	}
+	if err := outbox.Retry("flaky", dead[0].Record.ID); err != nil {
+		t.Fatalf("Retry() error: %v", err)
+	}
+	if err := outbox.Dispatch(ctx); err != nil {
+		t.Fatalf("Dispatch() error: %v", err)
+	}
+	if attempts != 7 {
+		t.Fatalf("expected the revived delivery to be tried, got %d attempts", attempts)
+	}
+}
+
+func TestOutboxConcurrency(t *testing.T) {
+	db := newTestDB(t)
+	outbox := newTestOutbox(t, db, nil)
+
+	var (
+		mu               sync.Mutex
+		running, maxSeen int
+		got              []string
+	)
+	err := outbox.Consume("pool", func(ctx context.Context, rec Record) error {
+		mu.Lock()
+		running++
+		maxSeen = max(maxSeen, running)
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		got = append(got, rec.Event.(CartCreated).CartID)
+		mu.Unlock()
+		return nil
+	}, ConsumeOptions{Concurrency: 3})
+	if err != nil {
+		t.Fatalf("Consume() error: %v", err)
+	}
+
+	for _, ID := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		stage(t, db, true, CartCreated{CartID: ID})
+	}
+	if err := outbox.Dispatch(context.Background()); err != nil {
+		t.Fatalf("Dispatch() error: %v", err)
+	}
+	if len(got) != 7 {
+		t.Fatalf("expected every event to be handled, got %v", got)
+	}
+	if maxSeen != 3 {
+		t.Fatalf("expected 3 events to be handled at once, got %d", maxSeen)
+	}
+	status, err := outbox.Consumers()
+	if err != nil {
+		t.Fatalf("Consumers() error: %v", err)
+	}
+	if status[0].Position != 7 {
+		t.Fatalf("expected the position to be past every event, got %d", status[0].Position)
+	}
+}
+
+// A slow consumer holds up neither the bus nor the other consumers.
+func TestOutboxRun(t *testing.T) {
+	db := newTestDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bus := newTestBus()
+	sub := bus.Subscribe()
+	defer sub.Close()
+	outbox := newTestOutbox(t, db, bus).WithPollInterval(time.Hour)
+	release := make(chan struct{})
+	defer close(release)
+	consume(t, outbox, "slow", func(ctx context.Context, rec Record) error {
+		<-release
+		return nil
+	})
+	fast := make(chan string, 2)
+	consume(t, outbox, "fast", func(ctx context.Context, rec Record) error {
+		fast <- rec.Event.(CartCreated).CartID
+		return nil
+	})
+	go outbox.Run(ctx)
+
+	for _, ID := range []string{"a", "b"} {
+		stage(t, db, true, CartCreated{CartID: ID})
+		outbox.Notify()
+		select {
+		case got := <-fast:
+			if got != ID {
+				t.Fatalf("fast consumer got %s, want %s", got, ID)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("fast consumer never got %s", ID)
+		}
+		if ev := receive(t, sub, 1)[0].(CartCreated); ev.CartID != ID {
+			t.Fatalf("bus got %s, want %s", ev.CartID, ID)
+		}
+	}
+}
+
+// Outboxes of several instances share the consumer, and each event is
+// handled by one of them.
+func TestOutboxInstances(t *testing.T) {
+	testOutboxInstances(t, newTestDB(t))
+}
+
+func testOutboxInstances(t *testing.T, db *sql.DB) {
+	ctx := context.Background()
+	var (
+		mu       sync.Mutex
+		attempts = make(map[string]int)
+	)
+	// every event fails the first time, and is handled on the retry
+	handle := func(ctx context.Context, rec Record) error {
+		time.Sleep(5 * time.Millisecond) // long enough for the other instance to get to it too
+		mu.Lock()
+		defer mu.Unlock()
+		ID := rec.Event.(CartCreated).CartID
+		attempts[ID]++
+		if attempts[ID] == 1 {
+			return errors.New("unavailable")
+		}
+		return nil
+	}
+	var outboxes []*Outbox
+	for range 2 {
+		outbox := newTestOutbox(t, db, nil)
+		err := outbox.Consume("shared", handle, ConsumeOptions{Concurrency: 2, Backoff: time.Nanosecond})
+		if err != nil {
+			t.Fatalf("Consume() error: %v", err)
+		}
+		outboxes = append(outboxes, outbox)
+	}
+
+	IDs := []string{"a", "b", "c", "d", "e", "f"}
+	for _, ID := range IDs {
+		stage(t, db, true, CartCreated{CartID: ID})
+	}
+	for range 3 {
+		var wg sync.WaitGroup
+		for _, outbox := range outboxes {
+			wg.Go(func() {
+				if err := outbox.Dispatch(ctx); err != nil {
+					t.Errorf("Dispatch() error: %v", err)
+				}
+			})
+		}
+		wg.Wait()
+	}
+	for _, ID := range IDs {
+		if attempts[ID] != 2 {
+			t.Errorf("event %s was attempted %d times, want a failure and a retry", ID, attempts[ID])
+		}
+	}
+	status, err := outboxes[0].Consumers()
+	if err != nil {
+		t.Fatalf("Consumers() error: %v", err)
+	}
+	if status[0].Pending != 0 || status[0].Dead != 0 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var bodies []string
+	status := http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	post := Webhook(srv.URL, srv.Client())
+	rec := Record{ID: 1, Type: "CartCreated", CartID: "cart", Payload: []byte(`{"CartID":"cart"}`)}
+	if err := post(context.Background(), rec); err == nil {
+		t.Fatalf("expected an error for a 503")
+	}
+	status = http.StatusNoContent
+	if err := post(context.Background(), rec); err != nil {
+		t.Fatalf("webhook error: %v", err)
+	}
+	if len(bodies) != 2 || bodies[1] == "" {
+		t.Fatalf("unexpected requests: %v", bodies)
+	}
+}
+
+func stage(t *testing.T, db *sql.DB, commit bool, ev Event) {
+	t.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Begin() error: %v", err)
+	}
+	if _, err := Stage(tx, dialect.Of(db), ev); err != nil {
+		t.Fatalf("Stage() error: %v", err)
+	}
+	if !commit {
+		tx.Rollback()
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit() error: %v", err)
+	}
+}
+
+func consume(t *testing.T, outbox *Outbox, name string, handle Handler) {
+	t.Helper()
+	if err := outbox.Consume(name, handle); err != nil {
+		t.Fatalf("Consume() error: %v", err)
+	}
+}
+
+func newTestOutbox(t *testing.T, db *sql.DB, bus *Bus) *Outbox {
+	t.Helper()
+	outbox, err := NewOutbox(db, bus, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("NewOutbox() error: %v", err)
+	}
+	return outbox
+}
@@ -0,0 +1,148 @@
+package events
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/kvalv/shoplist/dialect"
+	"github.com/kvalv/shoplist/migrations"
+	"github.com/kvalv/shoplist/pgtest"
+)
+
+func TestMain(m *testing.M) { os.Exit(pgtest.Main(m)) }
+
+// An event staged later may get its ID first. If it were committed first
+// too, the consumer would move past the earlier one before it's committed,
+// and never see it.
+func TestPostgresStageOrder(t *testing.T) {
+	db := newPostgresDB(t)
+	ctx := context.Background()
+	outbox := newTestOutbox(t, db, nil)
+	var got []string
+	consume(t, outbox, "test", func(ctx context.Context, rec Record) error {
+		got = append(got, rec.Event.(CartCreated).CartID)
+		return nil
+	})
+
+	first, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Begin() error: %v", err)
+	}
+	defer first.Rollback()
+	if _, err := Stage(first, dialect.Postgres, CartCreated{CartID: "first"}); err != nil {
+		t.Fatalf("Stage() error: %v", err)
+	}
+	second := make(chan struct{})
+	go func() {
+		defer close(second)
+		stage(t, db, true, CartCreated{CartID: "second"})
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	if err := outbox.Dispatch(ctx); err != nil {
+		t.Fatalf("Dispatch() error: %v", err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("consumer got %v before the first event was committed", got)
+	}
+
+	if err := first.Commit(); err != nil {
+		t.Fatalf("Commit() error: %v", err)
+	}
+	<-second
+	if err := outbox.Dispatch(ctx); err != nil {
+		t.Fatalf("Dispatch() error: %v", err)
+	}
+	if want := []string{"first", "second"}; !slices.Equal(got, want) {
+		t.Fatalf("consumer got %v, want %v", got, want)
+	}
+}
+
+func TestPostgresMultiInstance(t *testing.T) {
+	db := newPostgresDB(t)
+	testMultiInstance(t, func() *sql.DB { return db })
+}
+
+func TestPostgresOutboxInstances(t *testing.T) {
+	testOutboxInstances(t, newPostgresDB(t))
+}
+
+// A message committed after one with a higher ID is waited for, and one
+// that is never committed is given up on.
+func TestPostgresTransportGap(t *testing.T) {
+	db := newPostgresDB(t)
+	transport, err := NewDBTransport(db, time.Millisecond, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("NewDBTransport() error: %v", err)
+	}
+	tr := transport.(*dbTransport)
+	send := func(tx *sql.Tx, userID string) {
+		t.Helper()
+		_, err := tx.Exec(`insert into bus_messages(type, payload, created_at) values ('UserRegistered', $1, now())`, `{"UserID":"`+userID+`"}`)
+		if err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	receive := func() []string {
+		t.Helper()
+		evs, err := tr.receive(context.Background())
+		if err != nil {
+			t.Fatalf("receive() error: %v", err)
+		}
+		var got []string
+		for _, ev := range evs {
+			got = append(got, ev.(UserRegistered).UserID)
+		}
+		return got
+	}
+	begin := func() *sql.Tx {
+		t.Helper()
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatalf("Begin() error: %v", err)
+		}
+		return tx
+	}
+
+	slow, rolledBack := begin(), begin()
+	send(slow, "slow")
+	if err := transport.Send(UserRegistered{UserID: "fast"}); err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+	if got := receive(); len(got) != 0 {
+		t.Fatalf("received %v before the first message was committed", got)
+	}
+	if err := slow.Commit(); err != nil {
+		t.Fatalf("Commit() error: %v", err)
+	}
+	if got := receive(); !slices.Equal(got, []string{"slow", "fast"}) {
+		t.Fatalf("received %v, want slow and fast", got)
+	}
+
+	send(rolledBack, "lost")
+	rolledBack.Rollback()
+	if err := transport.Send(UserRegistered{UserID: "after"}); err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+	if got := receive(); len(got) != 0 {
+		t.Fatalf("received %v without waiting for the gap", got)
+	}
+	time.Sleep(gapWait)
+	if got := receive(); !slices.Equal(got, []string{"after"}) {
+		t.Fatalf("received %v, want the message after the gap", got)
+	}
+}
+
+func newPostgresDB(t *testing.T) *sql.DB {
+	db := pgtest.Open(t)
+	if err := migrations.MigratePostgres(db); err != nil {
+		t.Fatalf("failed to migrate: %s", err)
+	}
+	return db
+}
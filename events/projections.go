@@ -0,0 +1,111 @@
+package events
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A Projection is state derived from the event log. It can always be thrown
+// away and rebuilt with [Rebuild].
+type Projection interface {
+	Apply(rec Record)
+}
+
+// Rebuild replays the log of a cart (or every cart, if cartID is empty) into
+// the given projections.
+func Rebuild(store Store, cartID string, projections ...Projection) error {
+	return store.Replay(cartID, func(rec Record) error {
+		for _, p := range projections {
+			p.Apply(rec)
+		}
+		return nil
+	})
+}
+
+// ItemOrder keeps the items of each cart ordered by when they were last
+// touched, most recent first.
+type ItemOrder struct {
+	carts map[string][]string
+}
+
+func NewItemOrder() *ItemOrder {
+	return &ItemOrder{carts: make(map[string][]string)}
+}
+
+// Apply implements [Projection].
+func (o *ItemOrder) Apply(rec Record) {
+	cartID, _ := describe(rec.Event)
+	order := o.carts[cartID]
+	for _, ID := range touched(rec.Event) {
+		order = slices.DeleteFunc(order, func(s string) bool { return s == ID })
+		if _, removed := rec.Event.(ItemRemoved); !removed {
+			order = prepend(order, ID)
+		}
+	}
+	if cartID != "" {
+		o.carts[cartID] = order
+	}
+}
+
+// Items returns the item IDs of a cart, most recently touched first.
+func (o *ItemOrder) Items(cartID string) []string {
+	return slices.Clone(o.carts[cartID])
+}
+
+// Stats counts what has happened in a cart, and by whom.
+type Stats struct {
+	Events       int
+	ByType       map[string]int
+	ByActor      map[string]int
+	ItemsTouched int
+	First, Last  time.Time
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		ByType:  make(map[string]int),
+		ByActor: make(map[string]int),
+	}
+}
+
+// Apply implements [Projection].
+func (s *Stats) Apply(rec Record) {
+	s.Events++
+	s.ByType[rec.Type]++
+	if rec.Actor != "" {
+		s.ByActor[rec.Actor]++
+	}
+	s.ItemsTouched += len(touched(rec.Event))
+	if s.First.IsZero() {
+		s.First = rec.At
+	}
+	s.Last = rec.At
+}
+
+// Actors returns the users that did something, most active first.
+func (s *Stats) Actors() []string {
+	actors := slices.Collect(maps.Keys(s.ByActor))
+	slices.SortFunc(actors, func(a, b string) int {
+		if n := s.ByActor[b] - s.ByActor[a]; n != 0 {
+			return n
+		}
+		return strings.Compare(a, b)
+	})
+	return actors
+}
+
+// touched returns the items an event changed. CartUpdated only shows up in
+// logs from before the item events.
+func touched(ev Event) []string {
+	if ev, ok := ev.(CartUpdated); ok {
+		return ev.ItemIDs
+	}
+	if ID := itemOf(ev); ID != "" {
+		return []string{ID}
+	}
+	return nil
+}
+
+func prepend[T any](s []T, v T) []T { return append([]T{v}, s...) }
@@ -0,0 +1,221 @@
+package events
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/kvalv/shoplist/dialect"
+)
+
+// Record is an event as it is kept in the event log.
+type Record struct {
+	ID      int64
+	Type    string // e.g. "CartUpdated"
+	CartID  string
+	Actor   string
+	At      time.Time
+	Payload json.RawMessage
+	Event   Event // the decoded payload
+}
+
+// The Store is an append-only log of every event published on the bus.
+type Store interface {
+	// Appends the event to the log.
+	Append(ev Event) (Record, error)
+
+	// Returns the latest records for a cart, newest first.
+	History(cartID string, limit int) ([]Record, error)
+
+	// Calls fn for every record in the order they were appended. If cartID is
+	// non-empty, only records for that cart are visited. Replay stops at the
+	// first error returned by fn.
+	Replay(cartID string, fn func(Record) error) error
+}
+
+type sqlStore struct {
+	db      *sql.DB
+	dialect dialect.Dialect
+}
+
+// NewSqlStore keeps the log in the events table.
+func NewSqlStore(db *sql.DB) Store {
+	return &sqlStore{db: db, dialect: dialect.Of(db)}
+}
+
+// Append implements [Store].
+func (s *sqlStore) Append(ev Event) (Record, error) {
+	return appendTo(s.db, s.dialect, ev)
+}
+
+// appendTo logs an event in a transaction of its own.
+func appendTo(db *sql.DB, d dialect.Dialect, ev Event) (Record, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return Record{}, fmt.Errorf("sql: %w", err)
+	}
+	defer tx.Rollback()
+	rec, err := Stage(tx, d, ev)
+	if err != nil {
+		return Record{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Record{}, fmt.Errorf("sql: %w", err)
+	}
+	return rec, nil
+}
+
+// stageLock is the Postgres advisory lock that Stage takes.
+const stageLock = 7370686
+
+// Stage writes the event to the log as part of tx, so it is only kept if the
+// state change it describes is committed too. Once committed, the [Outbox]
+// dispatches it.
+//
+// The events must be committed in the order of their IDs, or the outbox
+// could move past an event before it's committed. SQLite has one writer at
+// a time, so that's a given; on Postgres, Stage takes a lock that is held
+// until tx is done, and transactions staging events wait for each other.
+func Stage(tx *sql.Tx, d dialect.Dialect, ev Event) (Record, error) {
+	if d == dialect.Postgres {
+		if _, err := tx.Exec(d.Rebind(`select pg_advisory_xact_lock(?)`), stageLock); err != nil {
+			return Record{}, fmt.Errorf("sql: %w", err)
+		}
+	}
+	return insert(tx, d, ev)
+}
+
+func insert(tx *sql.Tx, d dialect.Dialect, ev Event) (Record, error) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return Record{}, fmt.Errorf("marshal: %w", err)
+	}
+	cartID, actor := describe(ev)
+	rec := Record{
+		Type:    typeName(ev),
+		CartID:  cartID,
+		Actor:   actor,
+		At:      time.Now(),
+		Payload: payload,
+		Event:   ev,
+	}
+	row := tx.QueryRow(d.Rebind(`
+		insert into events(type, cart_id, actor, created_at, payload)
+		values (?, ?, ?, ?, ?)
+		returning id;
+	`), rec.Type, nullable(rec.CartID), nullable(rec.Actor), rec.At, string(payload))
+	if err := row.Scan(&rec.ID); err != nil {
+		return Record{}, fmt.Errorf("sql: %w", err)
+	}
+	return rec, nil
+}
+
+// History implements [Store].
+func (s *sqlStore) History(cartID string, limit int) ([]Record, error) {
+	rows, err := s.db.Query(s.dialect.Rebind(`
+		select id, type, cart_id, actor, created_at, payload
+		from events
+		where cart_id = ?
+		order by id desc
+		limit ?;
+	`), cartID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("sql: %w", err)
+	}
+	defer rows.Close()
+
+	var res []Record
+	for rows.Next() {
+		rec, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, rec)
+	}
+	return res, rows.Err()
+}
+
+// Replay implements [Store].
+func (s *sqlStore) Replay(cartID string, fn func(Record) error) error {
+	rows, err := s.db.Query(s.dialect.Rebind(`
+		select id, type, cart_id, actor, created_at, payload
+		from events
+		where ? = '' or cart_id = ?
+		order by id;
+	`), cartID, cartID)
+	if err != nil {
+		return fmt.Errorf("sql: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rec, err := scanRecord(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func scanRecord(rows *sql.Rows) (Record, error) {
+	var (
+		rec           Record
+		cartID, actor sql.NullString
+		payload       []byte
+	)
+	if err := rows.Scan(&rec.ID, &rec.Type, &cartID, &actor, &rec.At, &payload); err != nil {
+		return rec, fmt.Errorf("scan: %w", err)
+	}
+	rec.CartID, rec.Actor = cartID.String, actor.String
+	rec.Payload = payload
+
+	ev, err := Decode(rec.Type, payload)
+	if err != nil {
+		return rec, fmt.Errorf("record %d: %w", rec.ID, err)
+	}
+	rec.Event = ev
+	return rec, nil
+}
+
+var decoders = map[string]func([]byte) (Event, error){}
+
+// register makes an event type decodable from the log.
+func register[T Event]() {
+	var zero T
+	decoders[typeName(zero)] = func(b []byte) (Event, error) {
+		var ev T
+		if err := json.Unmarshal(b, &ev); err != nil {
+			return nil, err
+		}
+		return ev, nil
+	}
+}
+
+// Decode turns a stored payload back into the event of the given type.
+func Decode(typ string, payload []byte) (Event, error) {
+	decode, ok := decoders[typ]
+	if !ok {
+		return nil, fmt.Errorf("unknown event type %q", typ)
+	}
+	ev, err := decode(payload)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", typ, err)
+	}
+	return ev, nil
+}
+
+func typeName(ev Event) string {
+	return reflect.TypeOf(ev).Name()
+}
+
+func nullable(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
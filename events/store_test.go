@@ -0,0 +1,136 @@
+package events
+
+import (
+	"database/sql"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/kvalv/shoplist/migrations"
+	_ "modernc.org/sqlite"
+)
+
+func TestStore(t *testing.T) {
+	store := newTestStore(t)
+
+	published := []Event{
+		CartCreated{CartID: "cart1", Actor: "alice"},
+		ItemAdded{CartID: "cart1", ItemID: "milk", Text: "melk", Actor: "alice", At: time.Now()},
+		ItemAdded{CartID: "cart2", ItemID: "bread", Text: "brød", Actor: "bob", At: time.Now()},
+		ItemChecked{CartID: "cart1", ItemID: "milk", Actor: "bob", At: time.Now()},
+		UserRegistered{UserID: "carol"},
+	}
+	for _, ev := range published {
+		if _, err := store.Append(ev); err != nil {
+			t.Fatalf("Append(%T) error: %v", ev, err)
+		}
+	}
+
+	t.Run("history", func(t *testing.T) {
+		got, err := store.History("cart1", 10)
+		if err != nil {
+			t.Fatalf("History() error: %v", err)
+		}
+		if len(got) != 3 {
+			t.Fatalf("expected 3 records, got %d", len(got))
+		}
+		// newest first; bob checked the milk
+		last, ok := got[0].Event.(ItemChecked)
+		if !ok {
+			t.Fatalf("expected ItemChecked, got %T", got[0].Event)
+		}
+		if got[0].Actor != "bob" || last.ItemID != "milk" || last.At.IsZero() {
+			t.Fatalf("unexpected record: %+v", got[0])
+		}
+		if got[0].At.IsZero() {
+			t.Fatalf("expected timestamp to be set")
+		}
+	})
+
+	t.Run("replay everything", func(t *testing.T) {
+		var types []string
+		err := store.Replay("", func(rec Record) error {
+			types = append(types, rec.Type)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Replay() error: %v", err)
+		}
+		want := []string{"CartCreated", "ItemAdded", "ItemAdded", "ItemChecked", "UserRegistered"}
+		if !slices.Equal(types, want) {
+			t.Fatalf("got %v, want %v", types, want)
+		}
+	})
+
+	t.Run("projections", func(t *testing.T) {
+		order, stats := NewItemOrder(), NewStats()
+		if err := Rebuild(store, "", order, stats); err != nil {
+			t.Fatalf("Rebuild() error: %v", err)
+		}
+		if got := order.Items("cart1"); !slices.Equal(got, []string{"milk"}) {
+			t.Fatalf("ItemOrder(cart1) = %v", got)
+		}
+		if stats.Events != 5 || stats.ByType["ItemAdded"] != 2 || stats.ItemsTouched != 3 {
+			t.Fatalf("unexpected stats: %+v", stats)
+		}
+		if got := stats.Actors(); !slices.Equal(got, []string{"alice", "bob", "carol"}) {
+			t.Fatalf("Actors() = %v", got)
+		}
+	})
+}
+
+func TestItemOrder(t *testing.T) {
+	order := NewItemOrder()
+	for _, ev := range []Event{
+		ItemAdded{CartID: "cart", ItemID: "a"},
+		CartUpdated{CartID: "cart", ItemIDs: []string{"b", "c"}}, // from older logs
+		ItemAdded{CartID: "cart", ItemID: "d"},
+		ItemChecked{CartID: "cart", ItemID: "a"},
+		ItemRemoved{CartID: "cart", ItemID: "d"},
+	} {
+		order.Apply(Record{Event: ev})
+	}
+	if got, want := order.Items("cart"), []string{"a", "c", "b"}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestNotification(t *testing.T) {
+	cases := []struct {
+		ev   Event
+		want CartUpdated
+		ok   bool
+	}{
+		{ItemAdded{CartID: "cart", ItemID: "milk", Actor: "alice"}, CartUpdated{CartID: "cart", ItemIDs: []string{"milk"}, Actor: "alice"}, true},
+		{CartRenamed{CartID: "cart", Name: "Fredag", Actor: "bob"}, CartUpdated{CartID: "cart", Actor: "bob"}, true},
+		{ItemEnriched{CartID: "cart", ItemID: "milk"}, CartUpdated{CartID: "cart", ItemIDs: []string{"milk"}}, true},
+		{CandidateChosen{CartID: "cart", ItemID: "tape", Candidate: 2, Actor: "bob"}, CartUpdated{CartID: "cart", ItemIDs: []string{"tape"}, Actor: "bob"}, true},
+		{ItemStockChanged{CartID: "cart", ItemID: "tape", Stock: 3}, CartUpdated{CartID: "cart", ItemIDs: []string{"tape"}}, true},
+		{StockRefreshRequested{CartID: "cart", Actor: "alice"}, CartUpdated{}, false},
+		{CartSwitched{CartID: "cart", UserID: "alice"}, CartUpdated{}, false},
+		{CartUpdated{CartID: "cart"}, CartUpdated{}, false},
+	}
+	for _, tc := range cases {
+		got, ok := Notification(tc.ev)
+		if ok != tc.ok || got.CartID != tc.want.CartID || got.Actor != tc.want.Actor || !slices.Equal(got.ItemIDs, tc.want.ItemIDs) {
+			t.Errorf("Notification(%T) = %+v, %v; want %+v, %v", tc.ev, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func newTestStore(t *testing.T) Store {
+	return NewSqlStore(newTestDB(t))
+}
+
+func newTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open db: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+	if err := migrations.Migrate(db); err != nil {
+		t.Fatalf("failed to migrate: %s", err)
+	}
+	return db
+}
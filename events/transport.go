@@ -0,0 +1,140 @@
+package events
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/kvalv/shoplist/dialect"
+)
+
+// keep is how many messages the bus_messages table holds on to. An instance
+// that falls further behind than that misses events, which is fine for the
+// here-and-now subscribers of the bus.
+const keep = 1000
+
+// gapWait is how long a gap in the IDs of the messages is waited on. IDs are
+// handed out before the messages are committed, so on Postgres a message can
+// show up after one with a higher ID, and a failed insert leaves a gap for
+// good.
+const gapWait = time.Second
+
+type dbTransport struct {
+	db      *sql.DB
+	dialect dialect.Dialect
+	log     *slog.Logger
+	poll    time.Duration
+	last    int64     // last message received
+	gap     time.Time // when the gap after last was first seen, if any
+}
+
+// NewDBTransport connects the buses of every instance sharing the database,
+// through the bus_messages table, which is polled at the given interval. It
+// works the same with sqlite and postgres. Messages sent from now on are
+// received.
+func NewDBTransport(db *sql.DB, poll time.Duration, log *slog.Logger) (Transport, error) {
+	t := &dbTransport{db: db, dialect: dialect.Of(db), log: log, poll: poll}
+	if err := db.QueryRow(`select coalesce(max(id), 0) from bus_messages`).Scan(&t.last); err != nil {
+		return nil, fmt.Errorf("sql: %w", err)
+	}
+	return t, nil
+}
+
+// Send implements [Transport].
+func (t *dbTransport) Send(ev Event) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	_, err = t.db.Exec(t.dialect.Rebind(`
+		insert into bus_messages(type, payload, created_at)
+		values (?, ?, ?);
+	`), typeName(ev), string(payload), time.Now())
+	if err != nil {
+		return fmt.Errorf("sql: %w", err)
+	}
+	return nil
+}
+
+// Listen implements [Transport].
+func (t *dbTransport) Listen(ctx context.Context, deliver func(Event)) error {
+	ticker := time.NewTicker(t.poll)
+	defer ticker.Stop()
+	for polls := 0; ; polls++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		// what was received before an error is delivered still, as the
+		// position has moved past it
+		evs, err := t.receive(ctx)
+		for _, ev := range evs {
+			deliver(ev)
+		}
+		if err != nil {
+			t.log.Error("failed to receive", "error", err)
+			continue
+		}
+
+		// every instance cleans up now and then, so no one has to be in
+		// charge of it
+		if polls%100 == 0 {
+			if _, err := t.db.ExecContext(ctx, t.dialect.Rebind(`delete from bus_messages where id <= ?`), t.last-keep); err != nil {
+				t.log.Error("failed to clean up", "error", err)
+			}
+		}
+	}
+}
+
+// receive returns the messages after the last one received, in order. It
+// stops at a gap in the IDs, until the message is committed or gapWait has
+// passed.
+func (t *dbTransport) receive(ctx context.Context) ([]Event, error) {
+	rows, err := t.db.QueryContext(ctx, t.dialect.Rebind(`
+		select id, type, payload
+		from bus_messages
+		where id > ?
+		order by id;
+	`), t.last)
+	if err != nil {
+		return nil, fmt.Errorf("sql: %w", err)
+	}
+	defer rows.Close()
+
+	var evs []Event
+	for rows.Next() {
+		var (
+			id      int64
+			typ     string
+			payload []byte
+		)
+		if err := rows.Scan(&id, &typ, &payload); err != nil {
+			return evs, fmt.Errorf("scan: %w", err)
+		}
+		if id != t.last+1 {
+			if t.gap.IsZero() {
+				t.gap = time.Now()
+			}
+			if time.Since(t.gap) < gapWait {
+				break
+			}
+			t.log.Warn("skipping missing messages", "from", t.last+1, "to", id-1)
+		}
+		t.gap = time.Time{}
+		t.last = id
+
+		ev, err := Decode(typ, payload)
+		if err != nil {
+			// from a newer version, perhaps; the others can still be read
+			t.log.Warn("skipping message", "id", id, "error", err)
+			continue
+		}
+		evs = append(evs, ev)
+	}
+	return evs, rows.Err()
+}
@@ -0,0 +1,125 @@
+package events
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kvalv/shoplist/migrations"
+)
+
+// Two instances sharing a database, each with its own connections, bus and
+// outbox, like two replicas behind a proxy.
+func TestMultiInstance(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "shop.db") + "?_pragma=busy_timeout(5000)"
+	testMultiInstance(t, func() *sql.DB {
+		db, err := sql.Open("sqlite", dsn)
+		if err != nil {
+			t.Fatalf("failed to open db: %s", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		if err := migrations.Migrate(db); err != nil {
+			t.Fatalf("failed to migrate: %s", err)
+		}
+		return db
+	})
+}
+
+// testMultiInstance runs two instances on the databases returned by open.
+func testMultiInstance(t *testing.T, open func() *sql.DB) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type instance struct {
+		db     *sql.DB
+		bus    *Bus
+		outbox *Outbox
+		sub    *subscriber[Event]
+	}
+	var handled atomic.Int64
+	start := func() *instance {
+		db := open()
+		transport, err := NewDBTransport(db, 5*time.Millisecond, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		if err != nil {
+			t.Fatalf("NewDBTransport() error: %v", err)
+		}
+		bus := newTestBus().WithTransport(transport)
+		// room for every message of the burst below, read after the fact
+		sub := bus.Subscribe(SubscribeOptions{Buffer: 100})
+		go bus.Run(ctx)
+		outbox := newTestOutbox(t, db, bus)
+		consume(t, outbox, "worker", func(ctx context.Context, rec Record) error {
+			handled.Add(1)
+			return nil
+		})
+		return &instance{db: db, bus: bus, outbox: outbox, sub: sub}
+	}
+	a, b := start(), start()
+
+	// expect checks that every instance sees exactly the given events
+	expect := func(want ...string) {
+		t.Helper()
+		for _, in := range []*instance{a, b} {
+			for _, typ := range want {
+				select {
+				case ev := <-in.sub.Ch:
+					if got := typeName(ev); got != typ {
+						t.Fatalf("expected %s, got %s", typ, got)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatalf("timed out waiting for %s", typ)
+				}
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		for _, in := range []*instance{a, b} {
+			if n := len(in.sub.Ch); n != 0 {
+				t.Fatalf("expected no more events, got %d", n)
+			}
+		}
+	}
+
+	a.bus.Publish(CartSwitched{UserID: "alice", CartID: "cart"})
+	expect("CartSwitched")
+
+	// a change saved on one instance is published once, whichever instance
+	// dispatches it
+	stage(t, b.db, true, ItemAdded{CartID: "cart", ItemID: "milk", Actor: "bob"})
+	for _, in := range []*instance{a, b, a, b} {
+		if err := in.outbox.Dispatch(ctx); err != nil {
+			t.Fatalf("Dispatch() error: %v", err)
+		}
+	}
+	expect("ItemAdded", "CartUpdated")
+	if n := handled.Load(); n != 1 {
+		t.Fatalf("expected the event to be handled once, got %d", n)
+	}
+
+	// both publish at once, and neither misses a message of the other
+	const n = 50
+	var wg sync.WaitGroup
+	for _, in := range []*instance{a, b} {
+		wg.Go(func() {
+			for range n {
+				in.bus.Publish(CartSwitched{UserID: "alice", CartID: "cart"})
+			}
+		})
+		wg.Go(func() {
+			for i := range 2 * n {
+				select {
+				case <-in.sub.Ch:
+				case <-time.After(5 * time.Second):
+					t.Errorf("got %d of %d messages", i, 2*n)
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
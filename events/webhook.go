@@ -0,0 +1,43 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Webhook returns a handler that posts each event as JSON to url. Any
+// response but a 2xx is a failure, and the event is posted again later.
+func Webhook(url string, client *http.Client) Handler {
+	return func(ctx context.Context, rec Record) error {
+		body, err := json.Marshal(struct {
+			ID      int64           `json:"id"`
+			Type    string          `json:"type"`
+			CartID  string          `json:"cart_id,omitempty"`
+			Actor   string          `json:"actor,omitempty"`
+			At      time.Time       `json:"at"`
+			Payload json.RawMessage `json:"payload"`
+		}{rec.ID, rec.Type, rec.CartID, rec.Actor, rec.At, rec.Payload})
+		if err != nil {
+			return fmt.Errorf("marshal: %w", err)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("webhook responded %s", resp.Status)
+		}
+		return nil
+	}
+}
@@ -11,6 +11,44 @@ import (
 	"google.golang.org/genai"
 )
 
+// Settings apply to every query. They are set once at startup with
+// [Configure].
+type Settings struct {
+	APIKey    string // falls back to GEMINI_API_KEY when empty
+	Model     string // for plain queries
+	ToolModel string // for queries that call tools
+}
+
+var settings = Settings{
+	Model:     "gemini-2.5-flash",
+	ToolModel: "gemini-3-flash-preview",
+}
+
+// Configure replaces the settings. Empty fields keep their current value.
+func Configure(s Settings) {
+	if s.APIKey != "" {
+		settings.APIKey = s.APIKey
+	}
+	if s.Model != "" {
+		settings.Model = s.Model
+	}
+	if s.ToolModel != "" {
+		settings.ToolModel = s.ToolModel
+	}
+}
+
+// Configured reports whether there is an API key to query with.
+func Configured() bool {
+	return apiKey() != ""
+}
+
+func apiKey() string {
+	if settings.APIKey != "" {
+		return settings.APIKey
+	}
+	return os.Getenv("GEMINI_API_KEY")
+}
+
 type Options struct {
 	PrintQuery    bool
 	PrintResponse bool
@@ -47,16 +85,16 @@ func StructuredQuery(ctx context.Context, query string, recv any, opts ...Option
 	}
 
 	client, err := genai.NewClient(ctx, &genai.ClientConfig{
-		APIKey:  os.Getenv("GEMINI_API_KEY"),
+		APIKey:  apiKey(),
 		Backend: genai.BackendGeminiAPI,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to create genai client: %w", err)
 	}
 
-	model := "gemini-2.5-flash"
+	model := settings.Model
 	if len(opt.Tools) > 0 {
-		model = "gemini-3-flash-preview"
+		model = settings.ToolModel
 	}
 
 	contents := []*genai.Content{{
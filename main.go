@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
-	"database/sql"
+	"errors"
+	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/a-h/templ"
@@ -15,12 +18,15 @@ import (
 	"github.com/kvalv/shoplist/auth"
 	"github.com/kvalv/shoplist/carts"
 	"github.com/kvalv/shoplist/commands"
+	"github.com/kvalv/shoplist/config"
 	"github.com/kvalv/shoplist/cron"
 	"github.com/kvalv/shoplist/events"
-	"github.com/kvalv/shoplist/migrations"
+	"github.com/kvalv/shoplist/llm"
+	"github.com/kvalv/shoplist/stores"
+	"github.com/kvalv/shoplist/stores/clasohlson"
+	"github.com/kvalv/shoplist/stores/kiwi"
 	"github.com/kvalv/shoplist/views"
 	"github.com/starfederation/datastar-go/datastar"
-	_ "modernc.org/sqlite"
 )
 
 func main() {
@@ -35,67 +41,116 @@ func main() {
 		cancel()
 	}()
 
-	if err := run(ctx, log); err != nil {
-		log.Error(fmt.Sprintf("application error: %v", err))
-		os.Exit(1)
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
 	}
-}
-
-func run(ctx context.Context, log *slog.Logger) error {
-	db, err := sql.Open("sqlite", "file:shop.db")
 	if err != nil {
-		log.Error("failed to open db", "error", err)
+		log.Error(fmt.Sprintf("invalid configuration: %v", err))
 		os.Exit(1)
 	}
-	defer db.Close()
+	log.Info("effective configuration", "config", cfg)
 
-	if err := migrations.Migrate(db); err != nil {
-		return fmt.Errorf("failed to run migrations: %w", err)
+	if err := run(ctx, cfg, log); err != nil {
+		log.Error(fmt.Sprintf("application error: %v", err))
+		os.Exit(1)
 	}
+}
 
-	repo, err := carts.NewRepository(db)
+func run(ctx context.Context, cfg *config.Config, log *slog.Logger) error {
+	store, err := openStorage(cfg.DB.Driver, cfg.DB.DSN)
 	if err != nil {
-		return fmt.Errorf("failed to create cart repository: %w", err)
+		return err
 	}
+	defer store.db.Close()
+	db, repo := store.db, store.repo
+	log.Info("opened database", "driver", cfg.DB.Driver)
+
+	llm.Configure(llm.Settings{
+		APIKey:    cfg.LLM.APIKey,
+		Model:     cfg.LLM.Model,
+		ToolModel: cfg.LLM.ToolModel,
+	})
 
 	cron := cron.
-		New(ctx, cron.BackendSqlite(db)).
+		New(ctx, store.cron).
 		WithLogger(logger("cron")).
-		WithPollInterval(time.Minute*30).
+		WithPollInterval(time.Duration(cfg.Cron.PollInterval)).
 		MustRegister("Create new cart on the start of next week", "0 0 * * mon", func(ctx context.Context, attempt int) error {
 			cart := carts.New()
 			if err := repo.Save(cart); err != nil {
 				return fmt.Errorf("failed to create cart: %w", err)
 			}
-			// repo.AddCollaborators(cart.ID, "meg", "deg")
+			// repo.AddCollaborators(cart.ID, "cron", "meg", "deg")
 
 			log.Info("Created new cart", "cartID", cart.ID)
 			return nil
 		})
-	go cron.Run()
-	defer cron.Stop()
 
 	// Whenever a cart (item) is updated, we'll broadcast the event, so
-	// any client receives a new render.
+	// any client receives a new render. Events are written to the event log
+	// together with the change, and the outbox relays them to the bus and
+	// to the durable consumers. With more than one instance, the db transport
+	// makes sure every instance renders.
 	bus := events.NewBus(logger("bus"))
+	if cfg.Bus.Transport == "db" {
+		transport, err := events.NewDBTransport(db, time.Duration(cfg.Bus.PollInterval), logger("transport"))
+		if err != nil {
+			return fmt.Errorf("failed to create bus transport: %w", err)
+		}
+		bus.WithTransport(transport)
+		go bus.Run(ctx)
+	}
+	outbox, err := events.NewOutbox(db, bus, logger("outbox"))
+	if err != nil {
+		return fmt.Errorf("failed to create outbox: %w", err)
+	}
+	// a store gets candidates for its items by having an enricher here
+	clas := clasohlson.NewClient(cfg.Clas.StoreID).
+		WithRateLimit(float64(cfg.Clas.RateLimit), cfg.Clas.RateLimit).
+		WithTimeout(time.Duration(cfg.Clas.Timeout)).
+		WithRanking(clasohlson.Ranking(cfg.Clas.Ranking))
+	if cfg.Clas.Cache == "db" {
+		clas.WithCache(clasohlson.NewSqlCache(db, logger("clas")))
+	}
+	registry := stores.Stores.WithEnricher(stores.ClasOhlson, clas)
+	if cfg.Kiwi.Enabled {
+		registry = registry.WithEnricher(stores.Kiwi, kiwi.NewClient().WithTimeout(time.Duration(cfg.Kiwi.Timeout)))
+	}
+	enrichers := registry.Enrichers()
+	// stock changes during the day, so look it up again while the stores are open
+	cron.MustRegister("Refresh stock of open items", "0 7-21 * * *", NewStockRefreshJob(repo, outbox, enrichers, logger("worker")))
+	go cron.Run()
+	defer cron.Stop()
 
-	go RunBackgroundWorker(
-		ctx,
-		repo,
-		bus,
-		logger("worker"),
-	)
+	worker := NewWorker(repo, outbox, enrichers, logger("worker"))
+	err = outbox.Consume("worker", worker, events.ConsumeOptions{
+		Concurrency: cfg.Worker.Concurrency,
+		MaxAttempts: cfg.Worker.MaxAttempts,
+		Backoff:     time.Duration(cfg.Worker.Backoff),
+		OnDead:      NewWorkerFailed(repo, outbox, logger("worker")),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to register worker: %w", err)
+	}
+	if cfg.Webhook.URL != "" {
+		client := &http.Client{Timeout: 10 * time.Second}
+		if err := outbox.Consume("webhook", events.Webhook(cfg.Webhook.URL, client)); err != nil {
+			return fmt.Errorf("failed to register webhook: %w", err)
+		}
+	}
+	go outbox.Run(ctx)
 
 	r := chi.NewRouter().With(
 		auth.NewMockAuth(&auth.Claims{
-			UserID: "userID123",
-			Name:   "Markus Berg Lavby",
-			Email:  "kongenbefaler@email.com",
+			UserID: cfg.Auth.UserID,
+			Name:   cfg.Auth.Name,
+			Email:  cfg.Auth.Email,
 		}),
-		auth.RegisterUsers(db, logger("auth"), bus),
+		auth.RegisterUsers(db, logger("auth"), outbox),
 	)
 	server := http.Server{
-		Addr:    ":3001",
+		Addr:    cfg.Addr,
 		Handler: r,
 	}
 	go func() {
@@ -106,10 +161,33 @@ func run(ctx context.Context, log *slog.Logger) error {
 		}
 	}()
 
+	// page renders the first of the carts. If it has a store with several
+	// shops, they are listed to pick from, and the shop it is for is filled
+	// in if it says none: the one the viewer prefers, or else the default.
+	page := func(ctx context.Context, cs []*carts.Cart, userID string) templ.Component {
+		c := cs[0]
+		var shops []stores.Shop
+		store, _ := registry.Get(c.TargetStore)
+		if chain, ok := store.Enricher.(stores.Chain); ok {
+			if c.ShopID == "" {
+				c.ShopID, _ = repo.ShopPreference(userID, c.TargetStore)
+			}
+			if c.ShopID == "" {
+				c.ShopID = chain.ShopID()
+			}
+			shops = chain.Shops(ctx)
+		}
+		areas, err := repo.AreaOrder(c.TargetStore, c.ShopID)
+		if err != nil {
+			log.Error("failed to read area order", "error", err)
+		}
+		return views.Page(c, cs, registry, shops, areas)
+	}
+
 	// Initial render
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		carts, _ := repo.List(5)
-		templ.Handler(views.Page(carts[0], carts)).ServeHTTP(w, r)
+		templ.Handler(page(r.Context(), carts, auth.ClaimsFromRequest(r).UserID)).ServeHTTP(w, r)
 	})
 
 	r.HandleFunc("/static/", func(w http.ResponseWriter, r *http.Request) {
@@ -122,8 +200,46 @@ func run(ctx context.Context, log *slog.Logger) error {
 	// Render loop
 	r.HandleFunc("/render", func(w http.ResponseWriter, r *http.Request) {
 		sse := datastar.NewSSE(w, r)
+		userID := auth.ClaimsFromRequest(r).UserID
+
+		// Only re-render for changes to the carts on the page, new carts, and
+		// what the viewer does themselves.
+		var (
+			mu      sync.Mutex
+			visible []string
+		)
+		show := func(cs []*carts.Cart) {
+			mu.Lock()
+			defer mu.Unlock()
+			visible = visible[:0]
+			for _, c := range cs {
+				visible = append(visible, c.ID)
+			}
+		}
+		byViewer := events.ForUser(userID)
+		relevant := func(ev events.Event) bool {
+			switch ev.(type) {
+			case events.CartCreated:
+				return true
+			case events.CartUpdated, events.CartSwitched:
+			default:
+				// the changes themselves come with a CartUpdated
+				return false
+			}
+			if byViewer(ev) {
+				return true
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			return events.ForCart(visible...)(ev)
+		}
 
-		sub := bus.Subscribe()
+		// Every render is a full render, so only the latest event matters.
+		sub := bus.Subscribe(events.SubscribeOptions{
+			Policy: events.DropOldest,
+			Name:   "render",
+			Filter: relevant,
+		})
 		defer sub.Close()
 
 		// send initial render
@@ -131,29 +247,120 @@ func run(ctx context.Context, log *slog.Logger) error {
 		if len(carts) == 0 {
 			panic("no latest cart")
 		}
-		sse.PatchElementTempl(views.Page(carts[0], carts))
+		show(carts)
+		sse.PatchElementTempl(page(r.Context(), carts, userID))
 
 		done := r.Context().Done()
 		for {
 			select {
 			case <-done:
 				return
-			case event := <-sub.Ch:
+			case event, ok := <-sub.Ch:
+				if !ok {
+					return
+				}
 				carts, _ := repo.List(5)
+				show(carts)
 				log.Info("render fat morph",
 					"event", fmt.Sprintf("%T", event),
 					"cartID", carts[0].ID,
 				)
-				sse.PatchElementTempl(views.Page(carts[0], carts))
+				sse.PatchElementTempl(page(r.Context(), carts, userID))
 			}
 		}
 	})
 
-	r.HandleFunc("/add", commands.NewAddItem(repo, bus, log))
-	r.HandleFunc("/check", commands.NewCheckItem(repo, bus, log))
-	r.HandleFunc("/set-name", commands.NewSetName(repo, bus, log))
-	r.HandleFunc("/set-store", commands.NewSetStore(repo, bus, log))
-	r.HandleFunc("/switch-cart", commands.NewSwitchCart(repo, bus, log))
+	// Activity feed for a cart, rebuilt from the event log
+	r.HandleFunc("/activity", func(w http.ResponseWriter, r *http.Request) {
+		cart, err := repo.Cart(r.URL.Query().Get("cart"))
+		if err != nil {
+			http.Error(w, "cart not found", http.StatusNotFound)
+			return
+		}
+		history, err := store.events.History(cart.ID, 100)
+		if err != nil {
+			log.Error("failed to read history", "error", err)
+			http.Error(w, "failed to read history", http.StatusInternalServerError)
+			return
+		}
+		stats := events.NewStats()
+		if err := events.Rebuild(store.events, cart.ID, stats); err != nil {
+			log.Error("failed to replay events", "error", err)
+			http.Error(w, "failed to replay events", http.StatusInternalServerError)
+			return
+		}
+		templ.Handler(views.Activity(cart, registry, history, stats)).ServeHTTP(w, r)
+	})
+
+	// Deliveries the outbox gave up on, with a way to try them again
+	r.Get("/outbox", func(w http.ResponseWriter, r *http.Request) {
+		consumers, err := outbox.Consumers()
+		if err != nil {
+			log.Error("failed to read consumers", "error", err)
+			http.Error(w, "failed to read consumers", http.StatusInternalServerError)
+			return
+		}
+		dead, err := outbox.DeadLetters()
+		if err != nil {
+			log.Error("failed to read dead letters", "error", err)
+			http.Error(w, "failed to read dead letters", http.StatusInternalServerError)
+			return
+		}
+		templ.Handler(views.Outbox(consumers, dead)).ServeHTTP(w, r)
+	})
+	r.Post("/outbox/retry", func(w http.ResponseWriter, r *http.Request) {
+		eventID, err := strconv.ParseInt(r.FormValue("event"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad event ID", http.StatusBadRequest)
+			return
+		}
+		if err := outbox.Retry(r.FormValue("consumer"), eventID); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, r, "/outbox", http.StatusSeeOther)
+	})
+
+	// Live view of the bus. Like every other page, it's only served to
+	// signed in users.
+	if cfg.Debug {
+		r.Get("/debug/events", templ.Handler(views.DebugEvents()).ServeHTTP)
+		r.Get("/debug/events/stream", func(w http.ResponseWriter, r *http.Request) {
+			sse := datastar.NewSSE(w, r)
+			trace := bus.Trace(100)
+			defer trace.Close()
+
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			sse.PatchElementTempl(views.DebugSubscribers(bus.Subscriptions(), bus.Stats()))
+			for {
+				select {
+				case <-r.Context().Done():
+					return
+				case <-ticker.C:
+					sse.PatchElementTempl(views.DebugSubscribers(bus.Subscriptions(), bus.Stats()))
+				case tr := <-trace.Ch:
+					sse.PatchElementTempl(views.DebugTrace(tr),
+						datastar.WithSelectorID("traces"),
+						datastar.WithModePrepend(),
+					)
+				}
+			}
+		})
+		log.Info("debug pages enabled", "url", "/debug/events")
+	}
+
+	r.HandleFunc("/add", commands.NewAddItem(repo, outbox, enrichers, log))
+	r.HandleFunc("/choose-candidate", commands.NewChooseCandidate(repo, outbox, log))
+	r.HandleFunc("/check", commands.NewCheckItem(repo, outbox, log))
+	r.HandleFunc("/refresh-stock", commands.NewRefreshStock(repo, outbox, log))
+	r.HandleFunc("/remove", commands.NewRemoveItem(repo, outbox, log))
+	r.HandleFunc("/retry-enrichment", commands.NewRetryEnrichment(repo, outbox, log))
+	r.HandleFunc("/set-area-order", commands.NewSetAreaOrder(repo, outbox, log))
+	r.HandleFunc("/set-name", commands.NewSetName(repo, outbox, log))
+	r.HandleFunc("/set-shop", commands.NewSetShop(repo, outbox, log))
+	r.HandleFunc("/set-store", commands.NewSetStore(repo, outbox, registry, log))
+	r.HandleFunc("/switch-cart", commands.NewSwitchCart(repo, outbox, log))
 
 	log.Info("starting server", "addr", server.Addr)
 	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
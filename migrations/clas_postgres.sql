@@ -0,0 +1,32 @@
+-- Moves the Clas Ohlson candidates of old databases over to candidates and
+-- candidate_locations. Only run while clas_candidates is still around, see
+-- migrate.go.
+
+-- Shelf locations of a candidate, keyed by (item_id, idx) of clas_candidates.
+-- pos 0 is the primary location.
+CREATE TABLE IF NOT EXISTS clas_locations(
+    item_id text NOT NULL,
+    idx integer NOT NULL,
+    pos integer NOT NULL,
+    area text NOT NULL,
+    shelf text NOT NULL,
+    PRIMARY KEY (item_id, idx, pos),
+    FOREIGN KEY (item_id, idx) REFERENCES clas_candidates(item_id, idx) ON DELETE CASCADE
+);
+
+-- clas_candidates.area and .shelf used to hold the first location only.
+INSERT INTO clas_locations(item_id, idx, pos, area, shelf)
+SELECT item_id, idx, 0, area, shelf FROM clas_candidates
+WHERE area IS NOT NULL AND shelf IS NOT NULL
+ON CONFLICT DO NOTHING;
+
+-- Clas Ohlson (store 1) candidates from before any store could have them.
+INSERT INTO candidates(item_id, idx, store, product_id, name, price, url, picture, reviews, stock, chosen)
+SELECT c.item_id, c.idx, 1, c.gtm_id, c.name, c.price, c.url, c.picture, c.reviews, c.stock, coalesce(i.clas_chosen = c.idx, false)
+FROM clas_candidates c JOIN items i ON i.id = c.item_id
+ON CONFLICT DO NOTHING;
+INSERT INTO candidate_locations(item_id, idx, pos, area, shelf)
+SELECT item_id, idx, pos, area, shelf FROM clas_locations
+ON CONFLICT DO NOTHING;
+DROP TABLE IF EXISTS clas_locations;
+DROP TABLE IF EXISTS clas_candidates;
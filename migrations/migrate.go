@@ -3,12 +3,59 @@ package migrations
 import (
 	"database/sql"
 	_ "embed"
+	"fmt"
 )
 
 //go:embed migration.sql
 var migrationSQL string
 
+//go:embed postgres.sql
+var postgresSQL string
+
+//go:embed clas.sql
+var clasSQL string
+
+//go:embed clas_postgres.sql
+var clasPostgresSQL string
+
+// migrateLock is the Postgres advisory lock that keeps instances starting at
+// the same time from migrating at the same time.
+const migrateLock = 0x6d696772 // "migr"
+
 func Migrate(db *sql.DB) error {
-	_, err := db.Exec(migrationSQL)
-	return err
+	return migrate(db, migrationSQL,
+		`SELECT count(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'clas_candidates'`,
+		clasSQL)
+}
+
+// MigratePostgres is the Postgres counterpart of [Migrate].
+func MigratePostgres(db *sql.DB) error {
+	return migrate(db, `SELECT pg_advisory_xact_lock(`+fmt.Sprint(migrateLock)+`);`+postgresSQL,
+		`SELECT to_regclass('clas_candidates') IS NOT NULL`,
+		clasPostgresSQL)
+}
+
+// migrate brings the schema up to date, in one transaction. The legacy
+// clas_candidates are only moved over if the table is still there, which it
+// isn't after the first time.
+func migrate(db *sql.DB, schema, hasLegacy, legacy string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(schema); err != nil {
+		return err
+	}
+	var found bool
+	if err := tx.QueryRow(hasLegacy).Scan(&found); err != nil {
+		return fmt.Errorf("clas_candidates: %w", err)
+	}
+	if found {
+		if _, err := tx.Exec(legacy); err != nil {
+			return fmt.Errorf("clas_candidates: %w", err)
+		}
+	}
+	return tx.Commit()
 }
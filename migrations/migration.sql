@@ -54,23 +54,134 @@ CREATE TABLE IF NOT EXISTS items(
     created_by text REFERENCES users(user_id) ON DELETE SET NULL,
     updated_by text REFERENCES users(user_id) ON DELETE SET NULL,
     updated_at DATETIME,
-    clas_chosen integer
+    clas_chosen integer -- no longer used, see candidates.chosen
 );
 
-CREATE TABLE IF NOT EXISTS clas_candidates(
+-- Products of the target store an item may be about, see carts.Search. The
+-- chosen one used to be items.clas_chosen, which is no longer used.
+CREATE TABLE IF NOT EXISTS candidates(
     item_id text NOT NULL REFERENCES items(id) ON DELETE CASCADE,
     idx integer NOT NULL,
-    gtm_id text NOT NULL,
+    store integer NOT NULL,
+    product_id text NOT NULL,
     name text NOT NULL,
     price real NOT NULL,
     url text NOT NULL,
     picture text NOT NULL,
     reviews integer NOT NULL,
     stock integer NOT NULL,
-    area text,
-    shelf text,
+    chosen boolean NOT NULL DEFAULT false,
+    PRIMARY KEY (item_id, idx)
+);
+
+-- pos 0 is the primary location.
+CREATE TABLE IF NOT EXISTS candidate_locations(
+    item_id text NOT NULL,
+    idx integer NOT NULL,
+    pos integer NOT NULL,
+    area text NOT NULL,
+    shelf text NOT NULL,
+    PRIMARY KEY (item_id, idx, pos),
+    FOREIGN KEY (item_id, idx) REFERENCES candidates(item_id, idx) ON DELETE CASCADE
+);
+
+-- Where the worker is at finding candidates for an item, see
+-- carts.Enrichment. Replaces enrichment_failures, which only had the failed.
+CREATE TABLE IF NOT EXISTS enrichment_jobs(
+    item_id text PRIMARY KEY REFERENCES items(id) ON DELETE CASCADE,
+    state text NOT NULL,
+    attempts integer NOT NULL,
+    error text NOT NULL,
+    updated_at DATETIME NOT NULL
+);
+DROP TABLE IF EXISTS enrichment_failures;
+
+-- Responses from clasohlson.com, see clasohlson.NewSqlCache
+CREATE TABLE IF NOT EXISTS clas_cache(
+    key text PRIMARY KEY,
+    value text NOT NULL,
+    expires_at DATETIME NOT NULL
+);
+
+-- The shop of its target store a cart is for, see carts.Cart.ShopID, and the
+-- shop each user goes to for each store, which new choices default to.
+CREATE TABLE IF NOT EXISTS cart_shops(
+    cart_id text PRIMARY KEY REFERENCES carts(id) ON DELETE CASCADE,
+    shop_id text NOT NULL
+);
+CREATE TABLE IF NOT EXISTS user_shops(
+    user_id text NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    store integer NOT NULL,
+    shop_id text NOT NULL,
+    PRIMARY KEY (user_id, store)
+);
+
+-- The order to walk the areas of a shop in, see carts.Route.
+CREATE TABLE IF NOT EXISTS area_orders(
+    store integer NOT NULL,
+    shop_id text NOT NULL,
+    pos integer NOT NULL,
+    area text NOT NULL,
+    PRIMARY KEY (store, shop_id, pos)
+);
+
+-- Other shops of the chain with a candidate in stock, see
+-- stores.Candidate.Elsewhere.
+CREATE TABLE IF NOT EXISTS candidate_stock(
+    item_id text NOT NULL,
+    idx integer NOT NULL,
+    pos integer NOT NULL,
+    shop_id text NOT NULL,
+    name text NOT NULL,
+    stock integer NOT NULL,
+    PRIMARY KEY (item_id, idx, pos),
+    FOREIGN KEY (item_id, idx) REFERENCES candidates(item_id, idx) ON DELETE CASCADE
+);
+
+-- The price per unit of candidates, from stores that tell, see
+-- stores.Candidate.UnitPrice.
+CREATE TABLE IF NOT EXISTS candidate_unit_prices(
+    item_id text NOT NULL,
+    idx integer NOT NULL,
+    unit_price real NOT NULL,
+    unit text NOT NULL,
     PRIMARY KEY (item_id, idx),
-    UNIQUE (item_id, idx)
+    FOREIGN KEY (item_id, idx) REFERENCES candidates(item_id, idx) ON DELETE CASCADE
+);
+
+-- Event log, see events.Store
+CREATE TABLE IF NOT EXISTS events(
+    id integer PRIMARY KEY AUTOINCREMENT,
+    type text NOT NULL,
+    cart_id text,
+    actor text,
+    created_at DATETIME NOT NULL,
+    payload text NOT NULL
+);
+CREATE INDEX IF NOT EXISTS events_cart_id ON events(cart_id, id);
+
+-- Outbox, see events.Outbox. Each consumer reads the event log from its
+-- position; failed deliveries wait in outbox_deliveries for a retry.
+CREATE TABLE IF NOT EXISTS outbox_consumers(
+    name text PRIMARY KEY,
+    position integer NOT NULL
+);
+CREATE TABLE IF NOT EXISTS outbox_deliveries(
+    consumer text NOT NULL REFERENCES outbox_consumers(name),
+    event_id integer NOT NULL REFERENCES events(id),
+    attempts integer NOT NULL,
+    last_error text NOT NULL,
+    next_attempt_at DATETIME NOT NULL,
+    dead boolean NOT NULL DEFAULT false,
+    PRIMARY KEY (consumer, event_id)
+);
+
+-- Events on their way to the bus of every instance, see events.NewDBTransport
+CREATE TABLE IF NOT EXISTS bus_messages(
+    id integer PRIMARY KEY AUTOINCREMENT,
+    type text NOT NULL,
+    payload text NOT NULL,
+    created_at DATETIME NOT NULL
 );
 
 -- Cron tables
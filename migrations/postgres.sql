@@ -0,0 +1,206 @@
+-- Postgres equivalent of migration.sql. Keep the two in sync.
+
+-- User tables
+CREATE TABLE IF NOT EXISTS users(
+    user_id text PRIMARY KEY,
+    name text NOT NULL,
+    email text NOT NULL,
+    picture text NULL,
+    active_cart text NULL,
+    last_actiom timestamptz,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Cart tables
+CREATE TABLE IF NOT EXISTS carts(
+    id text PRIMARY KEY,
+    name text NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL,
+    created_by text REFERENCES users(user_id) ON DELETE SET NULL,
+    target_store integer NOT NULL,
+    inactive boolean NOT NULL DEFAULT FALSE
+);
+
+-- users and carts reference each other, so the foreign key is added once
+-- both tables exist.
+DO $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM pg_constraint WHERE conname = 'users_active_cart_fkey'
+    ) THEN
+        ALTER TABLE users
+            ADD CONSTRAINT users_active_cart_fkey
+            FOREIGN KEY (active_cart) REFERENCES carts(id) ON DELETE SET NULL;
+    END IF;
+END;
+$$;
+
+CREATE TABLE IF NOT EXISTS collaborators(
+    user_id text NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    cart_id text NOT NULL REFERENCES carts(id) ON DELETE CASCADE,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Postgres has no inline trigger bodies; the SQLite trigger of the same name
+-- becomes a function plus a trigger calling it.
+CREATE OR REPLACE FUNCTION ensure_collaborator() RETURNS trigger AS $$
+BEGIN
+    INSERT INTO collaborators(user_id, cart_id)
+    VALUES (NEW.created_by, NEW.id);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS ensure_collaborator ON carts;
+CREATE TRIGGER ensure_collaborator
+    AFTER INSERT ON carts
+    FOR EACH ROW
+    WHEN (NEW.created_by IS NOT NULL)
+    EXECUTE FUNCTION ensure_collaborator();
+
+CREATE TABLE IF NOT EXISTS items(
+    id text PRIMARY KEY,
+    cart_id text NOT NULL REFERENCES carts(id) ON DELETE CASCADE,
+    text text NOT NULL,
+    checked boolean NOT NULL,
+    created_at timestamptz NOT NULL,
+    created_by text REFERENCES users(user_id) ON DELETE SET NULL,
+    updated_by text REFERENCES users(user_id) ON DELETE SET NULL,
+    updated_at timestamptz,
+    clas_chosen integer -- no longer used, see candidates.chosen
+);
+
+-- Products of the target store an item may be about, see carts.Search. The
+-- chosen one used to be items.clas_chosen, which is no longer used.
+CREATE TABLE IF NOT EXISTS candidates(
+    item_id text NOT NULL REFERENCES items(id) ON DELETE CASCADE,
+    idx integer NOT NULL,
+    store integer NOT NULL,
+    product_id text NOT NULL,
+    name text NOT NULL,
+    price double precision NOT NULL,
+    url text NOT NULL,
+    picture text NOT NULL,
+    reviews integer NOT NULL,
+    stock integer NOT NULL,
+    chosen boolean NOT NULL DEFAULT false,
+    PRIMARY KEY (item_id, idx)
+);
+
+-- pos 0 is the primary location.
+CREATE TABLE IF NOT EXISTS candidate_locations(
+    item_id text NOT NULL,
+    idx integer NOT NULL,
+    pos integer NOT NULL,
+    area text NOT NULL,
+    shelf text NOT NULL,
+    PRIMARY KEY (item_id, idx, pos),
+    FOREIGN KEY (item_id, idx) REFERENCES candidates(item_id, idx) ON DELETE CASCADE
+);
+
+-- Where the worker is at finding candidates for an item, see
+-- carts.Enrichment. Replaces enrichment_failures, which only had the failed.
+CREATE TABLE IF NOT EXISTS enrichment_jobs(
+    item_id text PRIMARY KEY REFERENCES items(id) ON DELETE CASCADE,
+    state text NOT NULL,
+    attempts integer NOT NULL,
+    error text NOT NULL,
+    updated_at timestamptz NOT NULL
+);
+DROP TABLE IF EXISTS enrichment_failures;
+
+-- Responses from clasohlson.com, see clasohlson.NewSqlCache
+CREATE TABLE IF NOT EXISTS clas_cache(
+    key text PRIMARY KEY,
+    value text NOT NULL,
+    expires_at timestamptz NOT NULL
+);
+
+-- The shop of its target store a cart is for, see carts.Cart.ShopID, and the
+-- shop each user goes to for each store, which new choices default to.
+CREATE TABLE IF NOT EXISTS cart_shops(
+    cart_id text PRIMARY KEY REFERENCES carts(id) ON DELETE CASCADE,
+    shop_id text NOT NULL
+);
+CREATE TABLE IF NOT EXISTS user_shops(
+    user_id text NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    store integer NOT NULL,
+    shop_id text NOT NULL,
+    PRIMARY KEY (user_id, store)
+);
+
+-- The order to walk the areas of a shop in, see carts.Route.
+CREATE TABLE IF NOT EXISTS area_orders(
+    store integer NOT NULL,
+    shop_id text NOT NULL,
+    pos integer NOT NULL,
+    area text NOT NULL,
+    PRIMARY KEY (store, shop_id, pos)
+);
+
+-- Other shops of the chain with a candidate in stock, see
+-- stores.Candidate.Elsewhere.
+CREATE TABLE IF NOT EXISTS candidate_stock(
+    item_id text NOT NULL,
+    idx integer NOT NULL,
+    pos integer NOT NULL,
+    shop_id text NOT NULL,
+    name text NOT NULL,
+    stock integer NOT NULL,
+    PRIMARY KEY (item_id, idx, pos),
+    FOREIGN KEY (item_id, idx) REFERENCES candidates(item_id, idx) ON DELETE CASCADE
+);
+
+-- The price per unit of candidates, from stores that tell, see
+-- stores.Candidate.UnitPrice.
+CREATE TABLE IF NOT EXISTS candidate_unit_prices(
+    item_id text NOT NULL,
+    idx integer NOT NULL,
+    unit_price double precision NOT NULL,
+    unit text NOT NULL,
+    PRIMARY KEY (item_id, idx),
+    FOREIGN KEY (item_id, idx) REFERENCES candidates(item_id, idx) ON DELETE CASCADE
+);
+
+-- Event log, see events.Store
+CREATE TABLE IF NOT EXISTS events(
+    id bigserial PRIMARY KEY,
+    type text NOT NULL,
+    cart_id text,
+    actor text,
+    created_at timestamptz NOT NULL,
+    payload jsonb NOT NULL
+);
+CREATE INDEX IF NOT EXISTS events_cart_id ON events(cart_id, id);
+
+-- Outbox, see events.Outbox. Each consumer reads the event log from its
+-- position; failed deliveries wait in outbox_deliveries for a retry.
+CREATE TABLE IF NOT EXISTS outbox_consumers(
+    name text PRIMARY KEY,
+    position bigint NOT NULL
+);
+CREATE TABLE IF NOT EXISTS outbox_deliveries(
+    consumer text NOT NULL REFERENCES outbox_consumers(name),
+    event_id bigint NOT NULL REFERENCES events(id),
+    attempts integer NOT NULL,
+    last_error text NOT NULL,
+    next_attempt_at timestamptz NOT NULL,
+    dead boolean NOT NULL DEFAULT false,
+    PRIMARY KEY (consumer, event_id)
+);
+
+-- Events on their way to the bus of every instance, see events.NewDBTransport
+CREATE TABLE IF NOT EXISTS bus_messages(
+    id bigserial PRIMARY KEY,
+    type text NOT NULL,
+    payload jsonb NOT NULL,
+    created_at timestamptz NOT NULL
+);
+
+-- Cron tables
+CREATE TABLE IF NOT EXISTS cron_jobs(
+    name text PRIMARY KEY,
+    attempt int NOT NULL DEFAULT 0,
+    last_error text,
+    executed_at timestamptz
+);
@@ -0,0 +1,165 @@
+// Package pgtest hands out throwaway Postgres databases to integration tests.
+//
+// If SHOPLIST_TEST_POSTGRES holds a key/value connection string (e.g.
+// "host=localhost user=postgres sslmode=disable"), that server is used.
+// Otherwise a server is started in a temporary directory with initdb and
+// pg_ctl from PATH. Tests are skipped when neither is available.
+package pgtest
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	_ "github.com/lib/pq"
+	gonanoid "github.com/matoous/go-nanoid/v2"
+)
+
+const EnvDSN = "SHOPLIST_TEST_POSTGRES"
+
+var (
+	once sync.Once
+	srv  server
+)
+
+type server struct {
+	dsn  string // connection string without dbname
+	stop func()
+	err  error
+}
+
+// Open creates an empty database and returns a connection to it. The
+// database is dropped when the test finishes.
+func Open(t testing.TB) *sql.DB {
+	t.Helper()
+	once.Do(start)
+	if srv.err != nil {
+		t.Skipf("postgres not available: %s", srv.err)
+	}
+
+	admin, err := sql.Open("postgres", srv.dsn)
+	if err != nil {
+		t.Fatalf("failed to open admin connection: %s", err)
+	}
+	defer admin.Close()
+
+	name := "test_" + gonanoid.MustGenerate("abcdefghijklmnopqrstuvwxyz", 12)
+	if _, err := admin.Exec("CREATE DATABASE " + name); err != nil {
+		t.Fatalf("failed to create database: %s", err)
+	}
+
+	db, err := sql.Open("postgres", srv.dsn+" dbname="+name)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		admin, err := sql.Open("postgres", srv.dsn)
+		if err != nil {
+			return
+		}
+		defer admin.Close()
+		admin.Exec("DROP DATABASE IF EXISTS " + name)
+	})
+	return db
+}
+
+// Main runs the tests and stops the server started by [Open], if any. Use it
+// from TestMain:
+//
+//	func TestMain(m *testing.M) { os.Exit(pgtest.Main(m)) }
+func Main(m *testing.M) int {
+	code := m.Run()
+	if srv.stop != nil {
+		srv.stop()
+	}
+	return code
+}
+
+func start() {
+	if dsn := os.Getenv(EnvDSN); dsn != "" {
+		srv.dsn = dsn
+		srv.err = ping(dsn)
+		return
+	}
+
+	initdb, err := lookPath("initdb")
+	if err != nil {
+		srv.err = err
+		return
+	}
+	pgctl, err := lookPath("pg_ctl")
+	if err != nil {
+		srv.err = err
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "pgtest")
+	if err != nil {
+		srv.err = err
+		return
+	}
+	data := filepath.Join(dir, "data")
+
+	if out, err := exec.Command(initdb, "-D", data, "-U", "postgres", "-A", "trust", "--no-sync").CombinedOutput(); err != nil {
+		srv.err = fmt.Errorf("initdb: %w: %s", err, out)
+		os.RemoveAll(dir)
+		return
+	}
+
+	port, err := freePort()
+	if err != nil {
+		srv.err = err
+		os.RemoveAll(dir)
+		return
+	}
+	opts := fmt.Sprintf("-p %d -k %s -c listen_addresses=127.0.0.1 -F", port, dir)
+	if out, err := exec.Command(pgctl, "-D", data, "-l", filepath.Join(dir, "log"), "-o", opts, "-w", "start").CombinedOutput(); err != nil {
+		srv.err = fmt.Errorf("pg_ctl start: %w: %s", err, out)
+		os.RemoveAll(dir)
+		return
+	}
+	srv.stop = func() {
+		exec.Command(pgctl, "-D", data, "-m", "immediate", "stop").Run()
+		os.RemoveAll(dir)
+	}
+
+	srv.dsn = fmt.Sprintf("host=127.0.0.1 port=%d user=postgres sslmode=disable", port)
+	srv.err = ping(srv.dsn)
+}
+
+// lookPath finds a postgres binary on PATH, falling back to the Debian
+// layout where the binaries are not linked into PATH.
+func lookPath(name string) (string, error) {
+	if p, err := exec.LookPath(name); err == nil {
+		return p, nil
+	}
+	matches, _ := filepath.Glob(filepath.Join("/usr/lib/postgresql/*/bin", name))
+	if len(matches) > 0 {
+		return matches[len(matches)-1], nil
+	}
+	return "", fmt.Errorf("%s not found", name)
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func ping(dsn string) error {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Ping()
+}
@@ -6,12 +6,33 @@ import (
 	"html/template"
 	"log"
 	"net/url"
+	"slices"
 	"strings"
 
 	"github.com/kvalv/reciparse"
 	"github.com/kvalv/shoplist/llm"
 )
 
+// Sites are the recipe sites Parse is known to work with. They describe their
+// recipes with schema.org data, which is what reciparse reads.
+var Sites = []string{
+	"matprat.no",
+	"tine.no",
+	"godt.no",
+	"trinesmatblogg.no",
+	"allrecipes.com",
+	"bbcgoodfood.com",
+}
+
+// Supports tells whether the link is to one of the Sites, or a subdomain of
+// one, so that other pages are neither fetched nor sent to the LLM.
+func Supports(link *url.URL) bool {
+	host := strings.ToLower(link.Hostname())
+	return slices.ContainsFunc(Sites, func(site string) bool {
+		return host == site || strings.HasSuffix(host, "."+site)
+	})
+}
+
 func Parse(ctx context.Context, url *url.URL) ([]string, error) {
 	log.Printf("parsing recipe from url: %s", url.String())
 	got, err := reciparse.New().ParseRecipe(*url)
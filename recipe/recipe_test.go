@@ -17,3 +17,20 @@ func TestRecipe(t *testing.T) {
 		t.Logf("got %s", ing)
 	}
 }
+
+func TestSupports(t *testing.T) {
+	cases := map[string]bool{
+		"https://www.matprat.no/oppskrifter/tradisjon/finnbiff/": true,
+		"https://matprat.no/oppskrifter/":                        true,
+		"https://www.TINE.no/oppskrifter/lasagne":                true,
+		"https://example.com/oppskrifter/lasagne":                false,
+		"https://notmatprat.no/finnbiff":                         false,
+		"https://matprat.no.example.com/finnbiff":                false,
+	}
+	for link, want := range cases {
+		u, _ := url.Parse(link)
+		if got := Supports(u); got != want {
+			t.Errorf("Supports(%s) = %v, want %v", link, got, want)
+		}
+	}
+}
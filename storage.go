@@ -0,0 +1,76 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/kvalv/shoplist/carts"
+	"github.com/kvalv/shoplist/cron"
+	"github.com/kvalv/shoplist/events"
+	"github.com/kvalv/shoplist/migrations"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// storage bundles the database and the repositories built on top of it, so
+// the rest of main doesn't need to care which driver is in use.
+type storage struct {
+	db     *sql.DB
+	repo   carts.Repository
+	cron   cron.Backend
+	events events.Store
+}
+
+// openStorage opens and migrates the database for the given driver, which is
+// either "sqlite" or "postgres".
+func openStorage(driver, dsn string) (*storage, error) {
+	switch driver {
+	case "sqlite":
+		db, err := sql.Open("sqlite", sqliteDSN(dsn))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open db: %w", err)
+		}
+		if err := migrations.Migrate(db); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to run migrations: %w", err)
+		}
+		repo, err := carts.NewRepository(db)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create cart repository: %w", err)
+		}
+		return &storage{db: db, repo: repo, cron: cron.BackendSqlite(db), events: events.NewSqlStore(db)}, nil
+
+	case "postgres":
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open db: %w", err)
+		}
+		if err := migrations.MigratePostgres(db); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to run migrations: %w", err)
+		}
+		repo, err := carts.NewPostgresRepository(db)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create cart repository: %w", err)
+		}
+		return &storage{db: db, repo: repo, cron: cron.BackendPostgres(db), events: events.NewSqlStore(db)}, nil
+	}
+	return nil, fmt.Errorf("unknown database driver %q", driver)
+}
+
+// sqliteDSN makes connections wait for each other's writes, rather than fail
+// with SQLITE_BUSY, unless the DSN says otherwise. The worker writes from
+// several goroutines at once.
+func sqliteDSN(dsn string) string {
+	if strings.Contains(dsn, "busy_timeout") {
+		return dsn
+	}
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	return dsn + sep + "_pragma=busy_timeout(5000)"
+}
@@ -0,0 +1,100 @@
+package clasohlson
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/kvalv/shoplist/dialect"
+)
+
+// Cache holds responses from clasohlson.com for a while. A failing cache
+// is the same as an empty one.
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+}
+
+type entry struct {
+	value   []byte
+	expires time.Time
+}
+
+type memoryCache struct {
+	mu      sync.Mutex
+	entries map[string]entry
+	now     func() time.Time
+}
+
+// NewMemoryCache returns a cache that is gone when the process exits.
+func NewMemoryCache() Cache {
+	return &memoryCache{entries: make(map[string]entry), now: time.Now}
+}
+
+func (c *memoryCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (c *memoryCache) Set(key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = entry{value: value, expires: c.now().Add(ttl)}
+}
+
+type sqlCache struct {
+	db      *sql.DB
+	dialect dialect.Dialect
+	log     *slog.Logger
+	now     func() time.Time
+}
+
+// NewSqlCache returns a cache kept in the clas_cache table, which survives
+// restarts and is shared by every instance. It works with sqlite and
+// postgres. Errors are logged, and otherwise treated as a miss.
+func NewSqlCache(db *sql.DB, log *slog.Logger) Cache {
+	return &sqlCache{db: db, dialect: dialect.Of(db), log: log, now: time.Now}
+}
+
+func (c *sqlCache) Get(key string) ([]byte, bool) {
+	var value []byte
+	err := c.db.QueryRow(c.dialect.Rebind(`
+		select value from clas_cache
+		where key = ? and expires_at > ?;
+	`), key, c.now()).Scan(&value)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			c.log.Warn("failed to read cache", "key", key, "error", err)
+		}
+		return nil, false
+	}
+	return value, true
+}
+
+func (c *sqlCache) Set(key string, value []byte, ttl time.Duration) {
+	now := c.now()
+	_, err := c.db.Exec(c.dialect.Rebind(`
+		insert into clas_cache(key, value, expires_at)
+		values (?, ?, ?)
+		on conflict(key) do update set
+			value = excluded.value,
+			expires_at = excluded.expires_at;
+	`), key, string(value), now.Add(ttl))
+	if err != nil {
+		c.log.Warn("failed to write cache", "key", key, "error", err)
+	}
+	if _, err := c.db.Exec(c.dialect.Rebind(`delete from clas_cache where expires_at <= ?`), now); err != nil {
+		c.log.Warn("failed to expire cache", "error", err)
+	}
+}
@@ -0,0 +1,94 @@
+package clasohlson
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kvalv/shoplist/migrations"
+	_ "modernc.org/sqlite"
+)
+
+func TestCache(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open db: %s", err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	if err := migrations.Migrate(db); err != nil {
+		t.Fatalf("failed to migrate: %s", err)
+	}
+
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	memory := NewMemoryCache().(*memoryCache)
+	memory.now = clock
+	sqlite := NewSqlCache(db, slog.New(slog.NewTextHandler(io.Discard, nil))).(*sqlCache)
+	sqlite.now = clock
+
+	for name, cache := range map[string]Cache{"memory": memory, "sql": sqlite} {
+		t.Run(name, func(t *testing.T) {
+			now = time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+			if _, ok := cache.Get("search:skopose"); ok {
+				t.Fatalf("expected a miss on an empty cache")
+			}
+			cache.Set("search:skopose", []byte(`[{"ID":"1"}]`), time.Minute)
+			cache.Set("search:skopose", []byte(`[{"ID":"2"}]`), time.Minute)
+			if got, ok := cache.Get("search:skopose"); !ok || string(got) != `[{"ID":"2"}]` {
+				t.Fatalf("expected the latest value, got %q", got)
+			}
+
+			now = now.Add(time.Minute)
+			if got, ok := cache.Get("search:skopose"); ok {
+				t.Fatalf("expected the value to expire, got %q", got)
+			}
+		})
+	}
+}
+
+// A cache that can't be written to misses, and says why.
+func TestSqlCacheErrors(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open db: %s", err)
+	}
+	defer db.Close()
+
+	var logs bytes.Buffer
+	cache := NewSqlCache(db, slog.New(slog.NewTextHandler(&logs, nil)))
+	cache.Set("search:skopose", []byte(`[{"ID":"1"}]`), time.Minute)
+	if _, ok := cache.Get("search:skopose"); ok {
+		t.Fatalf("expected a miss")
+	}
+	for _, want := range []string{"failed to write cache", "failed to read cache"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("expected %q in the logs, got %s", want, logs.String())
+		}
+	}
+}
+
+func TestCached(t *testing.T) {
+	c := NewClient(CCVest)
+	var fetched int
+	fetch := func() ([]Item, error) {
+		fetched++
+		return []Item{{ID: "445689000", Name: "Skopose"}}, nil
+	}
+	for range 3 {
+		items, err := cached(c, "search:skopose", time.Minute, fetch)
+		if err != nil {
+			t.Fatalf("cached() error: %v", err)
+		}
+		if len(items) != 1 || items[0].Name != "Skopose" {
+			t.Fatalf("unexpected items: %+v", items)
+		}
+	}
+	if fetched != 1 {
+		t.Fatalf("expected one fetch, got %d", fetched)
+	}
+}
@@ -1,22 +1,86 @@
 package clasohlson
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
 	"fmt"
+	"maps"
 	"net/http"
 	"net/url"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/kvalv/shoplist/llm"
+	"github.com/kvalv/shoplist/stores"
 	"google.golang.org/genai"
 )
 
-type client struct {
+// Client talks to clasohlson.com. Responses are cached, and requests are
+// rate limited, so that enriching a long list doesn't hammer the site.
+type Client struct {
 	storeID string
+	baseURL string
+	http    *http.Client
+	cache   Cache
+	limit   *limiter
+	ranking Ranking
 }
 
-func NewClient(storeID string) *client {
-	return &client{storeID: storeID}
+// BaseURL is where the client finds clasohlson.com, unless told otherwise.
+const BaseURL = "https://www.clasohlson.com"
+
+// How long responses are cached. Stock changes during the day, while the
+// search results hardly do.
+const (
+	searchTTL       = 6 * time.Hour
+	availabilityTTL = 10 * time.Minute
+)
+
+func NewClient(storeID string) *Client {
+	return &Client{
+		storeID: storeID,
+		baseURL: BaseURL,
+		http:    &http.Client{Timeout: 10 * time.Second},
+		cache:   NewMemoryCache(),
+		limit:   newLimiter(2, 2),
+		ranking: RankLLM,
+	}
+}
+
+// WithCache replaces the default in-memory cache, see [NewSqlCache].
+func (c *Client) WithCache(cache Cache) *Client {
+	c.cache = cache
+	return c
+}
+
+// WithRateLimit allows perSecond requests on average, and up to burst at
+// once. Defaults to 2 a second, 2 at once.
+func (c *Client) WithRateLimit(perSecond float64, burst int) *Client {
+	c.limit = newLimiter(perSecond, burst)
+	return c
+}
+
+// WithTimeout bounds every request. Defaults to 10 seconds.
+func (c *Client) WithTimeout(d time.Duration) *Client {
+	h := *c.http
+	h.Timeout = d
+	c.http = &h
+	return c
+}
+
+// WithBaseURL points the client at another site than BaseURL, e.g. the fake
+// one of clasohlsontest. Links to products point there too.
+func (c *Client) WithBaseURL(u string) *Client {
+	c.baseURL = strings.TrimSuffix(u, "/")
+	return c
+}
+
+// WithHTTPClient replaces the client requests are made with.
+func (c *Client) WithHTTPClient(h *http.Client) *Client {
+	c.http = h
+	return c
 }
 
 var CCVest = "200"
@@ -26,6 +90,18 @@ type ShelfLocation struct {
 	Shelf string
 }
 
+// StoreStock is the stock of a product in a store. The name is empty when
+// the store isn't in the store list.
+type StoreStock struct {
+	StoreID string
+	Name    string
+	Stock   int
+}
+
+// elsewhere is how many other stores with a product in stock are kept, those
+// with the most first.
+const elsewhere = 3
+
 type Item struct {
 	ID        string
 	Name      string
@@ -35,87 +111,269 @@ type Item struct {
 	Reviews   int
 	Stock     int
 	Locations []ShelfLocation
+	Elsewhere []StoreStock // other stores with it in stock
 }
 
-func (c *client) Search(text string) ([]Item, error) {
-	resp, err := http.Get("https://www.clasohlson.com/no/search/getSearchResults?text=" + url.QueryEscape(text))
+// get fetches the URL, waiting for the rate limiter, and decodes the JSON
+// response into v.
+func (c *Client) get(ctx context.Context, url string, header http.Header, v any) error {
+	if err := c.limit.wait(ctx); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer resp.Body.Close()
-
-	var result struct {
-		CategoryResponseDTOs struct {
-			Products []struct {
-				GtmID         string  `json:"gtmId"`
-				Name          string  `json:"name"`
-				CurrentPrice  float64 `json:"currentPrice"`
-				URL           string  `json:"url"`
-				GridViewImage string  `json:"gridViewImage"`
-				Reviews       int     `json:"reviews"`
-				InStock       bool    `json:"inStock"`
-			} `json:"products"`
-		} `json:"categoryResponseDTOs"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
+	maps.Copy(req.Header, header)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
 	}
-
-	items := make([]Item, len(result.CategoryResponseDTOs.Products))
-	for i, p := range result.CategoryResponseDTOs.Products {
-		items[i] = Item{
-			ID:      p.GtmID,
-			Name:    p.Name,
-			Price:   p.CurrentPrice,
-			URL:     "https://www.clasohlson.com/no" + p.URL,
-			Picture: "https://www.clasohlson.com" + p.GridViewImage,
-			Reviews: p.Reviews,
-		}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
 	}
-	return items, nil
+	return json.NewDecoder(resp.Body).Decode(v)
 }
 
-func (c *client) Availability(item Item) (Item, error) {
-	req, _ := http.NewRequest("GET", "https://www.clasohlson.com/no/cocheckout/getCartDataOnReload?variantProductCode="+item.ID, nil)
-	req.Header.Set("Cookie", "COStoreCookie="+c.storeID)
-	resp, err := http.DefaultClient.Do(req)
+// cached returns what is cached under the key, or what fetch returns, which
+// is then cached for the given time. Errors are not cached.
+func cached[T any](c *Client, key string, ttl time.Duration, fetch func() (T, error)) (T, error) {
+	var v T
+	if b, ok := c.cache.Get(key); ok && json.Unmarshal(b, &v) == nil {
+		return v, nil
+	}
+	v, err := fetch()
 	if err != nil {
-		return item, err
+		return v, err
 	}
-	defer resp.Body.Close()
+	if b, err := json.Marshal(v); err == nil {
+		c.cache.Set(key, b, ttl)
+	}
+	return v, nil
+}
 
-	var result struct {
-		StoreStockList struct {
-			StockData []struct {
-				StoreID    string `json:"storeId"`
-				StoreStock int    `json:"storeStock"`
-				ShelfData  []struct {
-					AreaName     string `json:"areaName"`
-					ShelfNumbers string `json:"shelfNumbers"`
-				} `json:"shelfData"`
-			} `json:"stockData"`
-		} `json:"storeStockList"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return item, err
+func (c *Client) Search(ctx context.Context, text string) ([]Item, error) {
+	return cached(c, "search:"+text, searchTTL, func() ([]Item, error) {
+		var result struct {
+			CategoryResponseDTOs struct {
+				Products []struct {
+					GtmID         string  `json:"gtmId"`
+					Name          string  `json:"name"`
+					CurrentPrice  float64 `json:"currentPrice"`
+					URL           string  `json:"url"`
+					GridViewImage string  `json:"gridViewImage"`
+					Reviews       int     `json:"reviews"`
+					InStock       bool    `json:"inStock"`
+				} `json:"products"`
+			} `json:"categoryResponseDTOs"`
+		}
+		err := c.get(ctx, c.baseURL+"/no/search/getSearchResults?text="+url.QueryEscape(text), nil, &result)
+		if err != nil {
+			return nil, err
+		}
+
+		items := make([]Item, len(result.CategoryResponseDTOs.Products))
+		for i, p := range result.CategoryResponseDTOs.Products {
+			items[i] = Item{
+				ID:      p.GtmID,
+				Name:    p.Name,
+				Price:   p.CurrentPrice,
+				URL:     c.baseURL + "/no" + p.URL,
+				Picture: c.baseURL + p.GridViewImage,
+				Reviews: p.Reviews,
+			}
+		}
+		return items, nil
+	})
+}
+
+// Availability returns the item with its stock and shelf locations in the
+// store of the client, and the other stores with it in stock.
+func (c *Client) Availability(ctx context.Context, item Item) (Item, error) {
+	type availability struct {
+		StoreID   string
+		Stock     int
+		Locations []ShelfLocation
 	}
+	// every store is in the response, so one lookup serves them all
+	all, err := cached(c, "availability:"+item.ID, availabilityTTL, func() ([]availability, error) {
+		var result struct {
+			StoreStockList struct {
+				StockData []struct {
+					StoreID    string `json:"storeId"`
+					StoreStock int    `json:"storeStock"`
+					ShelfData  []struct {
+						AreaName     string `json:"areaName"`
+						ShelfNumbers string `json:"shelfNumbers"`
+					} `json:"shelfData"`
+				} `json:"stockData"`
+			} `json:"storeStockList"`
+		}
+		header := http.Header{"Cookie": {"COStoreCookie=" + c.storeID}}
+		err := c.get(ctx, c.baseURL+"/no/cocheckout/getCartDataOnReload?variantProductCode="+url.QueryEscape(item.ID), header, &result)
+		if err != nil {
+			return nil, err
+		}
 
-	for _, s := range result.StoreStockList.StockData {
-		if s.StoreID == c.storeID {
-			item.Stock = s.StoreStock
+		var all []availability
+		for _, s := range result.StoreStockList.StockData {
+			a := availability{StoreID: s.StoreID, Stock: s.StoreStock}
 			for _, shelf := range s.ShelfData {
-				item.Locations = append(item.Locations, ShelfLocation{
+				a.Locations = append(a.Locations, ShelfLocation{
 					Area:  shelf.AreaName,
 					Shelf: shelf.ShelfNumbers,
 				})
 			}
-			return item, nil
+			all = append(all, a)
 		}
+		return all, nil
+	})
+	if err != nil {
+		return item, err
+	}
+
+	i := slices.IndexFunc(all, func(a availability) bool { return a.StoreID == c.storeID })
+	if i < 0 {
+		return item, fmt.Errorf("store %s not found", c.storeID)
+	}
+	item.Stock = all[i].Stock
+	item.Locations = all[i].Locations
+	item.Elsewhere = nil
+	for _, a := range all {
+		if a.StoreID != c.storeID && a.Stock > 0 {
+			item.Elsewhere = append(item.Elsewhere, StoreStock{StoreID: a.StoreID, Stock: a.Stock})
+		}
+	}
+	slices.SortStableFunc(item.Elsewhere, func(a, b StoreStock) int { return cmp.Compare(b.Stock, a.Stock) })
+	if len(item.Elsewhere) > elsewhere {
+		item.Elsewhere = item.Elsewhere[:elsewhere]
+	}
+	if len(item.Elsewhere) > 0 {
+		names := map[string]string{}
+		for _, shop := range c.Shops(ctx) {
+			names[shop.ID] = shop.Name
+		}
+		for i, s := range item.Elsewhere {
+			item.Elsewhere[i].Name = names[s.StoreID]
+		}
+	}
+	return item, nil
+}
+
+// Enrich implements [stores.Enricher], with the top five products of Query.
+func (c *Client) Enrich(ctx context.Context, text string) ([]stores.Candidate, error) {
+	items, err := c.Query(ctx, text, 5)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]stores.Candidate, len(items))
+	for i, item := range items {
+		candidates[i] = candidate(item)
+	}
+	return candidates, nil
+}
+
+// Refresh implements [stores.Refresher], with the stock and locations from
+// Availability.
+func (c *Client) Refresh(ctx context.Context, cand stores.Candidate) (stores.Candidate, error) {
+	item, err := c.Availability(ctx, Item{ID: cand.ID})
+	if err != nil {
+		return cand, err
+	}
+	fresh := candidate(item)
+	cand.Stock = fresh.Stock
+	cand.Locations = fresh.Locations
+	cand.Elsewhere = fresh.Elsewhere
+	return cand, nil
+}
+
+// Product implements [stores.Linker], for links to product pages like
+// https://www.clasohlson.com/no/Skopose-med-sedertre,-2-pakning/p/44-5689.
+// The product is found by searching for its code.
+func (c *Client) Product(ctx context.Context, link *url.URL) (stores.Candidate, bool, error) {
+	ID, ok := c.productID(link)
+	if !ok {
+		return stores.Candidate{}, false, nil
+	}
+	items, err := c.Search(ctx, ID)
+	if err != nil {
+		return stores.Candidate{}, true, err
+	}
+	i := slices.IndexFunc(items, func(item Item) bool { return item.ID == ID })
+	if i < 0 {
+		return stores.Candidate{}, true, fmt.Errorf("product %s not found", ID)
+	}
+	item, err := c.Availability(ctx, items[i])
+	if err != nil {
+		return stores.Candidate{}, true, err
+	}
+	return candidate(item), true, nil
+}
+
+// productID returns the ID of the product a link on the site is to. The link
+// has the article number, like 44-5689, which is the ID without the variant.
+func (c *Client) productID(link *url.URL) (string, bool) {
+	site, err := url.Parse(c.baseURL)
+	if err != nil {
+		return "", false
+	}
+	host := link.Hostname()
+	if host != site.Hostname() && host != "clasohlson.com" && !strings.HasSuffix(host, ".clasohlson.com") {
+		return "", false
+	}
+	parts := strings.Split(strings.Trim(link.Path, "/"), "/")
+	i := slices.Index(parts, "p")
+	if i < 0 || i == len(parts)-1 {
+		return "", false
+	}
+	ID := strings.ReplaceAll(parts[i+1], "-", "")
+	if ID == "" || strings.Trim(ID, "0123456789") != "" {
+		return "", false
+	}
+	switch len(ID) {
+	case 6:
+		return ID + "000", true
+	case 9:
+		return ID, true
 	}
-	return item, fmt.Errorf("store %s not found", c.storeID)
+	return "", false
 }
 
-func (c *client) Query(ctx context.Context, query string, topk int) ([]Item, error) {
+func candidate(item Item) stores.Candidate {
+	cand := stores.Candidate{
+		ID:      item.ID,
+		Name:    item.Name,
+		Price:   item.Price,
+		URL:     item.URL,
+		Picture: item.Picture,
+		Reviews: item.Reviews,
+		Stock:   item.Stock,
+	}
+	for _, loc := range item.Locations {
+		cand.Locations = append(cand.Locations, stores.Location(loc))
+	}
+	for _, s := range item.Elsewhere {
+		cand.Elsewhere = append(cand.Elsewhere, stores.ShopStock{ShopID: s.StoreID, Name: s.Name, Stock: s.Stock})
+	}
+	return cand
+}
+
+// Query returns the topk products best matching the query, with their
+// availability. None is not an error. How they're ranked is decided by
+// WithRanking.
+func (c *Client) Query(ctx context.Context, query string, topk int) ([]Item, error) {
+	if c.ranking == RankSimple || !llm.Configured() {
+		return c.queryRanked(ctx, query, topk)
+	}
+	items, err := c.queryLLM(ctx, query, topk)
+	if err != nil && ctx.Err() == nil {
+		return c.queryRanked(ctx, query, topk)
+	}
+	return items, err
+}
+
+func (c *Client) queryLLM(ctx context.Context, query string, topk int) ([]Item, error) {
 	tools := []*genai.Tool{{
 		FunctionDeclarations: []*genai.FunctionDeclaration{
 			{
@@ -150,7 +408,7 @@ Return the product IDs ordered from best to worst match.`, topk, query)
 		Tools: tools,
 		ExecTool: func(name string, args map[string]any) (map[string]any, error) {
 			if name == "search" {
-				items, err := c.Search(args["query"].(string))
+				items, err := c.Search(ctx, args["query"].(string))
 				if err != nil {
 					return nil, err
 				}
@@ -174,7 +432,7 @@ Return the product IDs ordered from best to worst match.`, topk, query)
 	var items []Item
 	for _, id := range result.ProductIDs {
 		if item, ok := itemMap[id]; ok {
-			item, err := c.Availability(item)
+			item, err := c.Availability(ctx, item)
 			if err != nil {
 				return nil, err
 			}
@@ -184,9 +442,5 @@ Return the product IDs ordered from best to worst match.`, topk, query)
 			}
 		}
 	}
-
-	if len(items) == 0 {
-		return nil, fmt.Errorf("no matching products found for %q", query)
-	}
 	return items, nil
 }
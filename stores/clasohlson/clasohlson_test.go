@@ -2,10 +2,18 @@ package clasohlson
 
 import (
 	"context"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
 	"testing"
+
+	"github.com/kvalv/shoplist/stores"
+	"github.com/kvalv/shoplist/stores/clasohlson/clasohlsontest"
 )
 
 func TestSearchAndAvailability(t *testing.T) {
+	srv := clasohlsontest.NewServer(t)
 	tests := []struct {
 		query     string
 		wantName  string
@@ -17,7 +25,8 @@ func TestSearchAndAvailability(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		got, err := NewClient(CCVest).Search(tt.query)
+		client := NewClient(CCVest).WithBaseURL(srv.URL)
+		got, err := client.Search(context.Background(), tt.query)
 		if err != nil {
 			t.Fatalf("Search(%q) error = %v", tt.query, err)
 		}
@@ -32,11 +41,14 @@ func TestSearchAndAvailability(t *testing.T) {
 		if item.ID == "" {
 			t.Fatalf("Search(%q) did not find ID %q", tt.query, tt.wantID)
 		}
-		if item.URL == "" || item.Price == 0 {
-			t.Fatalf("Search(%q) missing URL or Price: %+v", tt.query, item)
+		if item.Name != tt.wantName || item.Price == 0 {
+			t.Fatalf("Search(%q) = %+v, want %q with a price", tt.query, item, tt.wantName)
+		}
+		if !strings.HasPrefix(item.URL, srv.URL+"/no/") || !strings.HasPrefix(item.Picture, srv.URL+"/") {
+			t.Fatalf("Search(%q) links elsewhere: %+v", tt.query, item)
 		}
 
-		item, err = NewClient(CCVest).Availability(item)
+		item, err = client.Availability(context.Background(), item)
 		if err != nil {
 			t.Fatalf("Availability(%v) error = %v", item.ID, err)
 		}
@@ -46,12 +58,93 @@ func TestSearchAndAvailability(t *testing.T) {
 		if len(item.Locations) == 0 {
 			t.Fatalf("Availability(%v) has no locations", item.ID)
 		}
-		t.Logf("Item: %+v", item)
+	}
+
+	if _, err := NewClient("999").WithBaseURL(srv.URL).Availability(context.Background(), Item{ID: "445689000"}); err == nil {
+		t.Errorf("Availability() in an unknown store: expected an error")
+	}
+	if n := srv.Requests("/no/search/getSearchResults"); n != len(tests) {
+		t.Errorf("expected a search request per query, got %d", n)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	srv := clasohlsontest.NewServer(t)
+	client := NewClient(CCVest).WithBaseURL(srv.URL)
+	cand := stores.Candidate{ID: "445689000", Name: "Skopose", Stock: 1}
+
+	got, err := client.Refresh(context.Background(), cand)
+	if err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	want := []stores.Location{{Area: "Hjem", Shelf: "31"}, {Area: "Kampanje", Shelf: "2"}}
+	if got.Name != "Skopose" || got.Stock != 42 || !slices.Equal(got.Locations, want) {
+		t.Errorf("Refresh() = %+v, want 42 at %v", got, want)
+	}
+	elsewhere := []stores.ShopStock{{ShopID: "215", Name: "Bergen Storsenter", Stock: 3}}
+	if !slices.Equal(got.Elsewhere, elsewhere) {
+		t.Errorf("Refresh() elsewhere = %+v, want %+v", got.Elsewhere, elsewhere)
+	}
+
+	// out of stock here, but not elsewhere
+	got, err = client.Refresh(context.Background(), stores.Candidate{ID: "404142000"})
+	if err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	elsewhere = []stores.ShopStock{{ShopID: "215", Name: "Bergen Storsenter", Stock: 17}}
+	if got.Stock != 0 || !slices.Equal(got.Elsewhere, elsewhere) {
+		t.Errorf("Refresh() = %+v, want 0 here and %+v", got, elsewhere)
+	}
+
+	// another shop of the chain has its own stock and shelves
+	got, err = client.AtShop("215").(stores.Refresher).Refresh(context.Background(), cand)
+	if err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	want = []stores.Location{{Area: "Hjem", Shelf: "12"}}
+	if got.Stock != 3 || !slices.Equal(got.Locations, want) {
+		t.Errorf("Refresh() at 215 = %+v, want 3 at %v", got, want)
+	}
+	if got.Elsewhere[0].ShopID != "200" {
+		t.Errorf("Refresh() at 215 elsewhere = %+v, want CC Vest", got.Elsewhere)
+	}
+	if n := srv.Requests("/no/cocheckout/getCartDataOnReload"); n != 2 {
+		t.Errorf("expected the stock of every store to be cached together, got %d requests", n)
+	}
+}
+
+func TestShops(t *testing.T) {
+	srv := clasohlsontest.NewServer(t)
+	client := NewClient(CCVest).WithBaseURL(srv.URL)
+	want := []stores.Shop{{ID: "215", Name: "Bergen Storsenter"}, {ID: "200", Name: "CC Vest"}}
+	for range 2 {
+		if got := client.Shops(context.Background()); !slices.Equal(got, want) {
+			t.Errorf("Shops() = %v, want %v", got, want)
+		}
+	}
+	if n := srv.Requests("/no/store-finder/getStores"); n != 1 {
+		t.Errorf("expected the store list to be cached, got %d requests", n)
+	}
+
+	// the fallback is used for a while when the list can't be fetched
+	srv.Fail(1)
+	client = NewClient(CCVest).WithBaseURL(srv.URL)
+	for range 2 {
+		if got := client.Shops(context.Background()); !slices.Equal(got, FallbackShops) {
+			t.Errorf("Shops() = %v, want the fallback", got)
+		}
+	}
+	if n := srv.Requests("/no/store-finder/getStores"); n != 2 {
+		t.Errorf("expected one more request, got %d", n)
 	}
 }
 
 func TestQuery(t *testing.T) {
-	items, err := NewClient(CCVest).Query(context.Background(), "skopose", 1)
+	if os.Getenv("GEMINI_API_KEY") == "" {
+		t.Skip("GEMINI_API_KEY not set")
+	}
+	srv := clasohlsontest.NewServer(t)
+	items, err := NewClient(CCVest).WithBaseURL(srv.URL).Query(context.Background(), "skopose", 1)
 	if err != nil {
 		t.Fatalf("Query() error = %v", err)
 	}
@@ -59,11 +152,43 @@ func TestQuery(t *testing.T) {
 		t.Fatalf("Query() returned %d items, want 1", len(items))
 	}
 	item := items[0]
-	if item.Stock == 0 {
-		t.Fatalf("Query() stock = 0, want non-zero")
+	if item.ID != "445689000" || item.Stock != 42 || len(item.Locations) == 0 {
+		t.Fatalf("Query() = %+v, want the skopose with stock and shelves", item)
 	}
-	if item.URL == "" || item.Price == 0 || len(item.Locations) == 0 {
-		t.Fatalf("Query() missing fields: %+v", item)
+}
+
+func TestProduct(t *testing.T) {
+	srv := clasohlsontest.NewServer(t)
+	client := NewClient(CCVest).WithBaseURL(srv.URL).WithRateLimit(100, 100)
+
+	for _, link := range []string{
+		"https://www.clasohlson.com/no/Gaffatape,-50-mm-x-25-m/p/40-4142",
+		"https://clasohlson.com/no/Gaffatape/p/404142000?utm_source=share",
+		srv.URL + "/no/p/404142000",
+	} {
+		u, _ := url.Parse(link)
+		got, ok, err := client.Product(context.Background(), u)
+		if err != nil || !ok {
+			t.Fatalf("Product(%s) = %v, %v", link, ok, err)
+		}
+		if got.ID != "404142000" || got.Name != "Gaffatape, 50 mm x 25 m" || got.Price == 0 || got.Stock != 0 || len(got.Elsewhere) != 1 {
+			t.Errorf("Product(%s) = %+v, want the gaffatape with its stock", link, got)
+		}
+	}
+
+	for _, link := range []string{
+		"https://www.clasohlson.com/no/kampanjer",
+		"https://www.clasohlson.com/no/Gaffatape/p/tape",
+		"https://www.matprat.no/oppskrifter/tradisjon/fiskesuppe/p/404142000",
+	} {
+		u, _ := url.Parse(link)
+		if _, ok, err := client.Product(context.Background(), u); ok || err != nil {
+			t.Errorf("Product(%s) = %v, %v; want it not to be a product link", link, ok, err)
+		}
+	}
+
+	u, _ := url.Parse("https://www.clasohlson.com/no/Sykkel/p/12-3456")
+	if _, ok, err := client.Product(context.Background(), u); !ok || err == nil {
+		t.Errorf("Product() of an unknown product = %v, %v; want an error", ok, err)
 	}
-	t.Logf("Got: %+v", item)
 }
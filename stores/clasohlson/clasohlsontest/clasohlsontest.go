@@ -0,0 +1,266 @@
+// Package clasohlsontest serves a fake clasohlson.com to tests, with the
+// endpoints the client uses: search, stock and shelves, and the store list.
+// Point a client at it with WithBaseURL:
+//
+//	srv := clasohlsontest.NewServer(t)
+//	client := clasohlson.NewClient("200").WithBaseURL(srv.URL)
+package clasohlsontest
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Product is a product of the fake site, with its stock and shelves in each
+// store, by store ID.
+type Product struct {
+	ID      string
+	Name    string
+	Price   float64
+	Reviews int
+	Stock   map[string]int
+	Shelves map[string][]Shelf
+}
+
+type Shelf struct {
+	Area  string
+	Shelf string
+}
+
+type Store struct {
+	ID   string
+	Name string
+}
+
+// Products and Stores are what a new server has.
+var (
+	Products = []Product{
+		{
+			ID:      "445689000",
+			Name:    "Skopose med sedertre, 2-pakning",
+			Price:   79.9,
+			Reviews: 112,
+			Stock:   map[string]int{"200": 42, "215": 3},
+			Shelves: map[string][]Shelf{
+				"200": {{Area: "Hjem", Shelf: "31"}, {Area: "Kampanje", Shelf: "2"}},
+				"215": {{Area: "Hjem", Shelf: "12"}},
+			},
+		},
+		{
+			ID:      "316328000",
+			Name:    "Fuglefrø i spann med lokk, 4 kg",
+			Price:   149,
+			Reviews: 37,
+			Stock:   map[string]int{"200": 8, "215": 0},
+			Shelves: map[string][]Shelf{
+				"200": {{Area: "Hage", Shelf: "4"}},
+			},
+		},
+		{
+			ID:      "404142000",
+			Name:    "Gaffatape, 50 mm x 25 m",
+			Price:   99.9,
+			Reviews: 410,
+			Stock:   map[string]int{"200": 0, "215": 17},
+			Shelves: map[string][]Shelf{
+				"200": {{Area: "Verktøy", Shelf: "9"}},
+				"215": {{Area: "Verktøy", Shelf: "14"}},
+			},
+		},
+	}
+	Stores = []Store{
+		{ID: "200", Name: "CC Vest"},
+		{ID: "215", Name: "Bergen Storsenter"},
+	}
+)
+
+// Server is the fake site. Its products can be changed while it runs.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	products []Product
+	stores   []Store
+	failures int
+	requests map[string]int
+}
+
+// NewServer starts a server with Products and Stores, closed when the test
+// ends.
+func NewServer(t testing.TB) *Server {
+	s := &Server{
+		products: clone(Products),
+		stores:   slices.Clone(Stores),
+		requests: map[string]int{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /no/search/getSearchResults", s.search)
+	mux.HandleFunc("GET /no/cocheckout/getCartDataOnReload", s.availability)
+	mux.HandleFunc("GET /no/store-finder/getStores", s.storeList)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[r.URL.Path]++
+		fail := s.failures > 0
+		if fail {
+			s.failures--
+		}
+		s.mu.Unlock()
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// SetStock changes the stock of a product in a store.
+func (s *Server) SetStock(productID, storeID string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.products {
+		if p.ID == productID {
+			p.Stock[storeID] = n
+		}
+	}
+}
+
+// Fail makes the next n requests fail with 503 Service Unavailable.
+func (s *Server) Fail(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = n
+}
+
+// Requests returns how many requests there have been to the path, e.g.
+// "/no/search/getSearchResults".
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// search returns the products with every word of the text in their name, or
+// the product with the text as its ID.
+func (s *Server) search(w http.ResponseWriter, r *http.Request) {
+	text := r.URL.Query().Get("text")
+	words := strings.Fields(strings.ToLower(text))
+	type product struct {
+		GtmID         string  `json:"gtmId"`
+		Name          string  `json:"name"`
+		CurrentPrice  float64 `json:"currentPrice"`
+		URL           string  `json:"url"`
+		GridViewImage string  `json:"gridViewImage"`
+		Reviews       int     `json:"reviews"`
+		InStock       bool    `json:"inStock"`
+	}
+	var result struct {
+		CategoryResponseDTOs struct {
+			Products []product `json:"products"`
+		} `json:"categoryResponseDTOs"`
+	}
+	result.CategoryResponseDTOs.Products = []product{}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.products {
+		name := strings.ToLower(p.Name)
+		if p.ID != text && (len(words) == 0 || !all(words, func(w string) bool { return strings.Contains(name, w) })) {
+			continue
+		}
+		var inStock bool
+		for _, n := range p.Stock {
+			inStock = inStock || n > 0
+		}
+		result.CategoryResponseDTOs.Products = append(result.CategoryResponseDTOs.Products, product{
+			GtmID:         p.ID,
+			Name:          p.Name,
+			CurrentPrice:  p.Price,
+			URL:           "/p/" + p.ID,
+			GridViewImage: "/images/" + p.ID + ".jpg",
+			Reviews:       p.Reviews,
+			InStock:       inStock,
+		})
+	}
+	writeJSON(w, result)
+}
+
+// availability returns the stock and shelves of a product in every store,
+// like the site does, whichever store the cookie is for.
+func (s *Server) availability(w http.ResponseWriter, r *http.Request) {
+	ID := r.URL.Query().Get("variantProductCode")
+	type shelf struct {
+		AreaName     string `json:"areaName"`
+		ShelfNumbers string `json:"shelfNumbers"`
+	}
+	type stock struct {
+		StoreID    string  `json:"storeId"`
+		StoreStock int     `json:"storeStock"`
+		ShelfData  []shelf `json:"shelfData"`
+	}
+	var result struct {
+		StoreStockList struct {
+			StockData []stock `json:"stockData"`
+		} `json:"storeStockList"`
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.products, func(p Product) bool { return p.ID == ID })
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	p := s.products[i]
+	for _, store := range s.stores {
+		st := stock{StoreID: store.ID, StoreStock: p.Stock[store.ID], ShelfData: []shelf{}}
+		for _, sh := range p.Shelves[store.ID] {
+			st.ShelfData = append(st.ShelfData, shelf{AreaName: sh.Area, ShelfNumbers: sh.Shelf})
+		}
+		result.StoreStockList.StockData = append(result.StoreStockList.StockData, st)
+	}
+	writeJSON(w, result)
+}
+
+func (s *Server) storeList(w http.ResponseWriter, r *http.Request) {
+	type store struct {
+		StoreID     string `json:"storeId"`
+		DisplayName string `json:"displayName"`
+	}
+	var result struct {
+		Stores []store `json:"stores"`
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, st := range s.stores {
+		result.Stores = append(result.Stores, store{StoreID: st.ID, DisplayName: st.Name})
+	}
+	writeJSON(w, result)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func all[T any](s []T, f func(T) bool) bool {
+	return !slices.ContainsFunc(s, func(v T) bool { return !f(v) })
+}
+
+// clone copies the products deep enough for SetStock not to change the
+// fixtures.
+func clone(products []Product) []Product {
+	out := slices.Clone(products)
+	for i, p := range out {
+		out[i].Stock = maps.Clone(p.Stock)
+	}
+	return out
+}
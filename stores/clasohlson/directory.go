@@ -0,0 +1,65 @@
+package clasohlson
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/kvalv/shoplist/stores"
+)
+
+// The store list hardly ever changes. When it can't be fetched, the fallback
+// is used for a while before trying again.
+const (
+	shopsTTL      = 24 * time.Hour
+	shopsRetryTTL = 10 * time.Minute
+)
+
+// FallbackShops is used when the store list can't be fetched.
+var FallbackShops = []stores.Shop{
+	{ID: CCVest, Name: "CC Vest"},
+}
+
+// Shops returns the stores of Clas Ohlson in Norway, by name, from the store
+// finder of the site. Should that fail, it returns FallbackShops.
+func (c *Client) Shops(ctx context.Context) []stores.Shop {
+	shops, err := cached(c, "shops", shopsTTL, func() ([]stores.Shop, error) {
+		var result struct {
+			Stores []struct {
+				StoreID     string `json:"storeId"`
+				DisplayName string `json:"displayName"`
+			} `json:"stores"`
+		}
+		if err := c.get(ctx, c.baseURL+"/no/store-finder/getStores", nil, &result); err != nil {
+			return nil, err
+		}
+		var shops []stores.Shop
+		for _, s := range result.Stores {
+			shops = append(shops, stores.Shop{ID: s.StoreID, Name: s.DisplayName})
+		}
+		slices.SortFunc(shops, func(a, b stores.Shop) int { return cmp.Compare(a.Name, b.Name) })
+		return shops, nil
+	})
+	if err != nil || len(shops) == 0 {
+		if b, err := json.Marshal(FallbackShops); err == nil {
+			c.cache.Set("shops", b, shopsRetryTTL)
+		}
+		return FallbackShops
+	}
+	return shops
+}
+
+// ShopID implements [stores.Chain], with the store the client was made for.
+func (c *Client) ShopID() string {
+	return c.storeID
+}
+
+// AtShop implements [stores.Chain], with a client for the store with the
+// given ID. It shares the cache and the rate limit with c.
+func (c *Client) AtShop(ID string) stores.Enricher {
+	shop := *c
+	shop.storeID = ID
+	return &shop
+}
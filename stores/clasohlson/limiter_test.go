@@ -0,0 +1,46 @@
+package clasohlson
+
+import (
+	"context"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l := newLimiter(2, 3)
+		ctx := context.Background()
+		start := time.Now()
+
+		// the burst goes right away, then one every half second
+		var at []time.Duration
+		for range 5 {
+			if err := l.wait(ctx); err != nil {
+				t.Fatalf("wait() error: %v", err)
+			}
+			at = append(at, time.Since(start))
+		}
+		want := []time.Duration{0, 0, 0, 500 * time.Millisecond, time.Second}
+		for i := range want {
+			if at[i] != want[i] {
+				t.Fatalf("request %d went at %s, want %s", i, at[i], want[i])
+			}
+		}
+
+		// a request given up on doesn't use up a token
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		if err := l.wait(ctx); err == nil {
+			t.Fatalf("expected the wait to be cut short")
+		}
+		time.Sleep(400 * time.Millisecond)
+		start = time.Now()
+		if err := l.wait(context.Background()); err != nil {
+			t.Fatalf("wait() error: %v", err)
+		}
+		if waited := time.Since(start); waited != 0 {
+			t.Fatalf("expected a token to be ready, waited %s", waited)
+		}
+	})
+}
@@ -0,0 +1,109 @@
+package clasohlson
+
+import (
+	"cmp"
+	"context"
+	"math"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Ranking is how Query picks the best products of a search.
+type Ranking string
+
+const (
+	// RankLLM has the LLM search and rank, falling back on RankSimple when
+	// it isn't configured or fails.
+	RankLLM Ranking = "llm"
+	// RankSimple scores the results of a plain search, see [Rank].
+	RankSimple Ranking = "simple"
+)
+
+// WithRanking decides how Query ranks products. Defaults to RankLLM.
+func (c *Client) WithRanking(r Ranking) *Client {
+	c.ranking = r
+	return c
+}
+
+// rankPool is how many of the best matching products by name have their
+// availability fetched before the final ranking, to keep the requests down.
+const rankPool = 10
+
+// queryRanked is Query without the LLM: it searches for the query, and ranks
+// the results with [Rank].
+func (c *Client) queryRanked(ctx context.Context, query string, topk int) ([]Item, error) {
+	items, err := c.Search(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	items = Rank(query, items)
+	if len(items) > rankPool {
+		items = items[:rankPool]
+	}
+	for i, item := range items {
+		if items[i], err = c.Availability(ctx, item); err != nil {
+			return nil, err
+		}
+	}
+	items = Rank(query, items)
+	if len(items) > topk {
+		items = items[:topk]
+	}
+	return items, nil
+}
+
+// Rank orders the items from best to worst match of the query, and leaves
+// out those sharing no word with it. The score is mostly how many words of
+// the query are in the name, then how popular the item is by its reviews,
+// and whether it's in stock. Ties keep their order.
+func Rank(query string, items []Item) []Item {
+	words := tokens(query)
+	type scored struct {
+		item  Item
+		score float64
+	}
+	var ranked []scored
+	for _, item := range items {
+		overlap := overlap(words, tokens(item.Name))
+		if overlap == 0 {
+			continue
+		}
+		score := 20*overlap + math.Log1p(float64(item.Reviews))
+		if item.Stock > 0 {
+			score += 2
+		}
+		ranked = append(ranked, scored{item, score})
+	}
+	slices.SortStableFunc(ranked, func(a, b scored) int { return cmp.Compare(b.score, a.score) })
+
+	out := make([]Item, len(ranked))
+	for i, r := range ranked {
+		out[i] = r.item
+	}
+	return out
+}
+
+// overlap is the share of the words found in the name. A word inside a
+// longer one, like "tape" in "gaffatape", counts half.
+func overlap(words, name []string) float64 {
+	if len(words) == 0 {
+		return 0
+	}
+	var n float64
+	for _, w := range words {
+		switch {
+		case slices.Contains(name, w):
+			n++
+		case slices.ContainsFunc(name, func(s string) bool { return strings.Contains(s, w) }):
+			n += 0.5
+		}
+	}
+	return n / float64(len(words))
+}
+
+func tokens(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
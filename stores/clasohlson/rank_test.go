@@ -0,0 +1,74 @@
+package clasohlson
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/kvalv/shoplist/stores/clasohlson/clasohlsontest"
+)
+
+func TestRank(t *testing.T) {
+	items := []Item{
+		{ID: "hammer", Name: "Snekkerhammer, 450 g", Reviews: 80, Stock: 4},
+		{ID: "gaffa", Name: "Gaffatape, 50 mm x 25 m", Reviews: 410, Stock: 12},
+		{ID: "tape-black", Name: "Tape, svart", Reviews: 3, Stock: 0},
+		{ID: "tape-white", Name: "Tape, hvit", Reviews: 3, Stock: 5},
+		{ID: "duct", Name: "Duct tape, 48 mm", Reviews: 25, Stock: 7},
+		{ID: "bag", Name: "Skopose med sedertre, 2-pakning", Reviews: 112},
+	}
+
+	cases := []struct {
+		query string
+		want  []string
+	}{
+		// whole words first, then by reviews and stock
+		{"tape", []string{"duct", "tape-white", "tape-black", "gaffa"}},
+		{"Duct tape", []string{"duct", "tape-white", "gaffa", "tape-black"}},
+		{"svart tape", []string{"tape-black", "duct", "tape-white", "gaffa"}},
+		{"hammer", []string{"hammer"}},
+		{"SKOPOSE!", []string{"bag"}},
+		{"sykkel", nil},
+		{"", nil},
+	}
+	for _, tc := range cases {
+		var got []string
+		for _, item := range Rank(tc.query, items) {
+			got = append(got, item.ID)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("Rank(%q) = %v, want %v", tc.query, got, tc.want)
+		}
+	}
+
+	// ties keep the order of the search
+	tied := []Item{{ID: "a", Name: "Tape"}, {ID: "b", Name: "Tape"}, {ID: "c", Name: "Tape"}}
+	for range 10 {
+		if got := Rank("tape", tied); got[0].ID != "a" || got[1].ID != "b" || got[2].ID != "c" {
+			t.Fatalf("Rank() reordered ties: %v", got)
+		}
+	}
+}
+
+func TestQuerySimple(t *testing.T) {
+	srv := clasohlsontest.NewServer(t)
+	client := NewClient(CCVest).WithBaseURL(srv.URL).WithRanking(RankSimple).WithRateLimit(100, 100)
+
+	items, err := client.Query(context.Background(), "skopose", 5)
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+	if len(items) != 1 || items[0].ID != "445689000" || items[0].Stock != 42 || len(items[0].Locations) == 0 {
+		t.Fatalf("Query() = %+v, want the skopose with stock and shelves", items)
+	}
+
+	items, err = client.Query(context.Background(), "sykkel", 5)
+	if err != nil || len(items) != 0 {
+		t.Fatalf("Query() = %v, %v; want nothing", items, err)
+	}
+
+	srv.Fail(1)
+	if _, err := client.Query(context.Background(), "fuglefrø", 5); err == nil {
+		t.Fatalf("Query() expected an error when the site fails")
+	}
+}
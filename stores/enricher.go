@@ -0,0 +1,118 @@
+package stores
+
+import (
+	"context"
+	"maps"
+	"net/url"
+	"slices"
+)
+
+// Candidate is a product in a store that may be what an item is about.
+type Candidate struct {
+	ID        string // the store's product ID
+	Name      string
+	Price     float64
+	UnitPrice float64 // per Unit; zero if the store doesn't tell
+	Unit      string  // e.g. "kg", "l" or "stk"
+	URL       string
+	Picture   string
+	Reviews   int
+	Stock     int         // in the store we shop at
+	Locations []Location  // primary location first; empty if the store doesn't tell
+	Elsewhere []ShopStock // other shops of the chain with it in stock, most first
+}
+
+// ShopStock is how many of a product a shop has.
+type ShopStock struct {
+	ShopID string
+	Name   string // empty if unknown
+	Stock  int
+}
+
+// Location is where in a store a product is.
+type Location struct {
+	Area  string
+	Shelf string
+}
+
+// Enricher finds the products of a store that match the text of an item,
+// best match first.
+type Enricher interface {
+	Enrich(ctx context.Context, text string) ([]Candidate, error)
+}
+
+// Refresher is implemented by enrichers that can tell how many of a
+// candidate they found earlier are in stock now, and where.
+type Refresher interface {
+	Refresh(ctx context.Context, c Candidate) (Candidate, error)
+}
+
+// Linker is implemented by enrichers that know the links to the products on
+// the site of their store.
+type Linker interface {
+	// Product returns the product the link is to, with its stock. It returns
+	// false if the link isn't to one of theirs.
+	Product(ctx context.Context, link *url.URL) (Candidate, bool, error)
+}
+
+// Chain is implemented by enrichers of stores with several shops, where stock
+// and shelves differ from shop to shop.
+type Chain interface {
+	// Shops lists the shops to pick from.
+	Shops(ctx context.Context) []Shop
+	// ShopID is the shop it is at, unless told otherwise with AtShop.
+	ShopID() string
+	// AtShop returns an enricher for the shop with the given ID.
+	AtShop(ID string) Enricher
+}
+
+// Enrichers are the enrichers of the stores that have one. Items in carts
+// for other stores are left as they are.
+type Enrichers map[Store]Enricher
+
+// For returns the enricher of the store, if it has one.
+func (e Enrichers) For(s Store) (Enricher, bool) {
+	enricher, ok := e[s]
+	return enricher, ok
+}
+
+// At returns the enricher of the store, for the shop if the store has
+// several and one is given.
+func (e Enrichers) At(s Store, shopID string) (Enricher, bool) {
+	enricher, ok := e[s]
+	if chain, isChain := enricher.(Chain); isChain && shopID != "" {
+		enricher = chain.AtShop(shopID)
+	}
+	return enricher, ok
+}
+
+// Refresher returns the enricher of the store, like At, if it can refresh
+// candidates.
+func (e Enrichers) Refresher(s Store, shopID string) (Refresher, bool) {
+	enricher, _ := e.At(s, shopID)
+	r, ok := enricher.(Refresher)
+	return r, ok
+}
+
+// Product returns the product a link is to, and its store. The store given
+// is asked first, at the shop, then the others.
+func (e Enrichers) Product(ctx context.Context, link *url.URL, s Store, shopID string) (Store, Candidate, bool, error) {
+	for i, store := range append([]Store{s}, slices.Sorted(maps.Keys(e))...) {
+		if i > 0 && store == s {
+			continue
+		}
+		enricher := e[store]
+		if i == 0 {
+			enricher, _ = e.At(s, shopID)
+		}
+		linker, ok := enricher.(Linker)
+		if !ok {
+			continue
+		}
+		c, ok, err := linker.Product(ctx, link)
+		if ok || err != nil {
+			return store, c, ok, err
+		}
+	}
+	return s, Candidate{}, false, nil
+}
@@ -0,0 +1,154 @@
+// Package kiwi searches the product catalogue of Kiwi, through the API of
+// NorgesGruppen that kiwi.no is built on.
+package kiwi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kvalv/shoplist/stores"
+)
+
+// BaseURL is where the client finds the catalogue, unless told otherwise.
+const BaseURL = "https://platform-rest-prod.ngdata.no"
+
+// The chain ID of Kiwi in the catalogue, which is shared by the stores of
+// NorgesGruppen, and where product pages and pictures are.
+const (
+	chainID  = "1100"
+	siteURL  = "https://kiwi.no"
+	imageURL = "https://bilder.ngdata.no"
+)
+
+// Client searches the Kiwi catalogue. Prices are the same in every store of
+// the chain, and there is no stock or shelf to tell.
+type Client struct {
+	baseURL string
+	http    *http.Client
+}
+
+func NewClient() *Client {
+	return &Client{
+		baseURL: BaseURL,
+		http:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// WithTimeout bounds every request. Defaults to 10 seconds.
+func (c *Client) WithTimeout(d time.Duration) *Client {
+	h := *c.http
+	h.Timeout = d
+	c.http = &h
+	return c
+}
+
+// WithBaseURL points the client at another catalogue than BaseURL, e.g. the
+// fake one of kiwitest.
+func (c *Client) WithBaseURL(u string) *Client {
+	c.baseURL = strings.TrimSuffix(u, "/")
+	return c
+}
+
+// WithHTTPClient replaces the client requests are made with.
+func (c *Client) WithHTTPClient(h *http.Client) *Client {
+	c.http = h
+	return c
+}
+
+type Product struct {
+	EAN       string
+	Name      string
+	Price     float64
+	UnitPrice float64 // per Unit, for comparing packages of different size
+	Unit      string  // e.g. "kg", "l" or "stk"
+	URL       string
+	Picture   string
+}
+
+// Search returns the products best matching the text, at most limit, best
+// first.
+func (c *Client) Search(ctx context.Context, text string, limit int) ([]Product, error) {
+	q := url.Values{
+		"search":    {text},
+		"page_size": {fmt.Sprint(limit)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/api/episearch/"+chainID+"/products?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("search %q: %s", text, resp.Status)
+	}
+
+	var result struct {
+		Hits struct {
+			Hits []struct {
+				Source struct {
+					EAN                 string  `json:"ean"`
+					Title               string  `json:"title"`
+					Subtitle            string  `json:"subtitle"`
+					PricePerUnit        float64 `json:"pricePerUnit"`
+					ComparePricePerUnit float64 `json:"comparePricePerUnit"`
+					CompareUnit         string  `json:"compareUnit"`
+					ImageName           string  `json:"imageName"`
+					SlugifiedURL        string  `json:"slugifiedUrl"`
+				} `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("search %q: %w", text, err)
+	}
+
+	var products []Product
+	for _, hit := range result.Hits.Hits {
+		p := hit.Source
+		product := Product{
+			EAN:       p.EAN,
+			Name:      strings.TrimSpace(p.Title + " " + p.Subtitle),
+			Price:     p.PricePerUnit,
+			UnitPrice: p.ComparePricePerUnit,
+			Unit:      p.CompareUnit,
+			URL:       siteURL + "/varer/" + p.SlugifiedURL,
+		}
+		if p.ImageName != "" {
+			product.Picture = imageURL + "/" + p.ImageName + "/small.jpg"
+		}
+		products = append(products, product)
+		if len(products) == limit {
+			break
+		}
+	}
+	return products, nil
+}
+
+// Enrich implements [stores.Enricher], with the top five products of Search.
+func (c *Client) Enrich(ctx context.Context, text string) ([]stores.Candidate, error) {
+	products, err := c.Search(ctx, text, 5)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]stores.Candidate, len(products))
+	for i, p := range products {
+		candidates[i] = stores.Candidate{
+			ID:        p.EAN,
+			Name:      p.Name,
+			Price:     p.Price,
+			UnitPrice: p.UnitPrice,
+			Unit:      p.Unit,
+			URL:       p.URL,
+			Picture:   p.Picture,
+		}
+	}
+	return candidates, nil
+}
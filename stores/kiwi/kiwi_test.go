@@ -0,0 +1,59 @@
+package kiwi
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kvalv/shoplist/stores/kiwi/kiwitest"
+)
+
+func TestSearch(t *testing.T) {
+	srv := kiwitest.NewServer(t)
+	client := NewClient().WithBaseURL(srv.URL)
+
+	got, err := client.Search(context.Background(), "melk", 5)
+	if err != nil {
+		t.Fatalf("Search() error = %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("Search() = %+v, want the two kinds of milk", got)
+	}
+	want := Product{
+		EAN:       "7038010001628",
+		Name:      "Helmelk 3,5% fett 1,75 l",
+		Price:     41.5,
+		UnitPrice: 23.71,
+		Unit:      "l",
+		URL:       "https://kiwi.no/varer/7038010001628",
+		Picture:   "https://bilder.ngdata.no/7038010001628/small.jpg",
+	}
+	if got[1] != want {
+		t.Errorf("Search()[1] = %+v, want %+v", got[1], want)
+	}
+
+	if got, err := client.Search(context.Background(), "melk", 1); err != nil || len(got) != 1 {
+		t.Errorf("Search() with a limit of 1 = %v, %v", got, err)
+	}
+	if got, err := client.Search(context.Background(), "sykkel", 5); err != nil || len(got) != 0 {
+		t.Errorf("Search() = %v, %v; want nothing", got, err)
+	}
+
+	srv.Fail(1)
+	if _, err := client.Search(context.Background(), "melk", 5); err == nil {
+		t.Errorf("Search() expected an error when the catalogue fails")
+	}
+}
+
+func TestEnrich(t *testing.T) {
+	srv := kiwitest.NewServer(t)
+	got, err := NewClient().WithBaseURL(srv.URL).Enrich(context.Background(), "kneippbrød")
+	if err != nil {
+		t.Fatalf("Enrich() error = %v", err)
+	}
+	if len(got) != 1 || got[0].ID != "7040913336684" || got[0].Price != 32.9 || got[0].UnitPrice != 43.87 || got[0].Unit != "kg" {
+		t.Fatalf("Enrich() = %+v, want the kneippbrød with its unit price", got)
+	}
+	if n := srv.Requests("/api/episearch/1100/products"); n != 1 {
+		t.Errorf("expected one request, got %d", n)
+	}
+}
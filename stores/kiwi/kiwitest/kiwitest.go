@@ -0,0 +1,141 @@
+// Package kiwitest serves a fake Kiwi catalogue to tests. Point a client at
+// it with WithBaseURL:
+//
+//	srv := kiwitest.NewServer(t)
+//	client := kiwi.NewClient().WithBaseURL(srv.URL)
+package kiwitest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Product is a product of the fake catalogue.
+type Product struct {
+	EAN       string
+	Title     string
+	Subtitle  string
+	Price     float64
+	UnitPrice float64
+	Unit      string
+}
+
+// Products are what a new server has.
+var Products = []Product{
+	{EAN: "7038010000737", Title: "Lettmelk 0,5% fett", Subtitle: "1 l", Price: 24.9, UnitPrice: 24.9, Unit: "l"},
+	{EAN: "7038010001628", Title: "Helmelk 3,5% fett", Subtitle: "1,75 l", Price: 41.5, UnitPrice: 23.71, Unit: "l"},
+	{EAN: "7040913336684", Title: "Kneippbrød", Subtitle: "750 g", Price: 32.9, UnitPrice: 43.87, Unit: "kg"},
+	{EAN: "7311041013663", Title: "Bananer", Subtitle: "løsvekt", Price: 29.9, UnitPrice: 29.9, Unit: "kg"},
+}
+
+// Server is the fake catalogue.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	products []Product
+	failures int
+	requests map[string]int
+}
+
+// NewServer starts a server with Products, closed when the test ends.
+func NewServer(t testing.TB) *Server {
+	s := &Server{
+		products: slices.Clone(Products),
+		requests: map[string]int{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/episearch/1100/products", s.search)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[r.URL.Path]++
+		fail := s.failures > 0
+		if fail {
+			s.failures--
+		}
+		s.mu.Unlock()
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Fail makes the next n requests fail with 503 Service Unavailable.
+func (s *Server) Fail(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = n
+}
+
+// Requests returns how many requests there have been to the path, e.g.
+// "/api/episearch/1100/products".
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// search returns the products with a word of the search in their title, at
+// most page_size of them.
+func (s *Server) search(w http.ResponseWriter, r *http.Request) {
+	words := strings.Fields(strings.ToLower(r.URL.Query().Get("search")))
+	size, err := strconv.Atoi(r.URL.Query().Get("page_size"))
+	if err != nil {
+		size = 10
+	}
+	type source struct {
+		EAN                 string  `json:"ean"`
+		Title               string  `json:"title"`
+		Subtitle            string  `json:"subtitle"`
+		PricePerUnit        float64 `json:"pricePerUnit"`
+		ComparePricePerUnit float64 `json:"comparePricePerUnit"`
+		CompareUnit         string  `json:"compareUnit"`
+		ImageName           string  `json:"imageName"`
+		SlugifiedURL        string  `json:"slugifiedUrl"`
+	}
+	type hit struct {
+		Source source `json:"_source"`
+	}
+	var result struct {
+		Hits struct {
+			Total int   `json:"total"`
+			Hits  []hit `json:"hits"`
+		} `json:"hits"`
+	}
+	result.Hits.Hits = []hit{}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.products {
+		title := strings.ToLower(p.Title)
+		if !slices.ContainsFunc(words, func(w string) bool { return strings.Contains(title, w) }) {
+			continue
+		}
+		result.Hits.Total++
+		if len(result.Hits.Hits) == size {
+			continue
+		}
+		result.Hits.Hits = append(result.Hits.Hits, hit{source{
+			EAN:                 p.EAN,
+			Title:               p.Title,
+			Subtitle:            p.Subtitle,
+			PricePerUnit:        p.Price,
+			ComparePricePerUnit: p.UnitPrice,
+			CompareUnit:         p.Unit,
+			ImageName:           p.EAN,
+			SlugifiedURL:        p.EAN,
+		}})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,67 @@
+package stores
+
+import "slices"
+
+// Capability is something a store can tell about its products.
+type Capability uint8
+
+const (
+	Search        Capability = 1 << iota // products by name, with their price
+	Availability                         // how many there are in a shop
+	ShelfLocation                        // where in a shop they are
+)
+
+// Info is a store as listed in a [Registry].
+type Info struct {
+	ID           Store
+	Name         string
+	Capabilities Capability
+	Enricher     Enricher // nil if its items aren't looked up
+}
+
+// Can reports whether the store has every one of the capabilities.
+func (i Info) Can(c Capability) bool {
+	return i.Capabilities&c == c
+}
+
+// Registry lists the stores a cart can be for, in the order they're offered.
+type Registry []Info
+
+// Stores are the stores there are, without enrichers, see
+// [Registry.WithEnricher].
+var Stores = Registry{
+	{ID: Kiwi, Name: "Kiwi", Capabilities: Search},
+	{ID: ClasOhlson, Name: "Clas Ohlson", Capabilities: Search | Availability | ShelfLocation},
+}
+
+// Get returns the store with the ID, if there is one.
+func (r Registry) Get(ID Store) (Info, bool) {
+	i := slices.IndexFunc(r, func(info Info) bool { return info.ID == ID })
+	if i < 0 {
+		return Info{}, false
+	}
+	return r[i], true
+}
+
+// WithEnricher returns a copy of the registry, where the store with the ID
+// has its items looked up by the enricher.
+func (r Registry) WithEnricher(ID Store, e Enricher) Registry {
+	r = slices.Clone(r)
+	for i := range r {
+		if r[i].ID == ID {
+			r[i].Enricher = e
+		}
+	}
+	return r
+}
+
+// Enrichers returns the enrichers of the stores that have one.
+func (r Registry) Enrichers() Enrichers {
+	enrichers := Enrichers{}
+	for _, info := range r {
+		if info.Enricher != nil {
+			enrichers[info.ID] = info.Enricher
+		}
+	}
+	return enrichers
+}
@@ -0,0 +1,34 @@
+package stores
+
+import (
+	"context"
+	"testing"
+)
+
+type fakeEnricher struct{}
+
+func (fakeEnricher) Enrich(context.Context, string) ([]Candidate, error) { return nil, nil }
+
+func TestRegistry(t *testing.T) {
+	if _, ok := Stores.Get(Store(7)); ok {
+		t.Errorf("Get() found a store that isn't there")
+	}
+	clas, ok := Stores.Get(ClasOhlson)
+	if !ok || clas.Name != "Clas Ohlson" || !clas.Can(Search|ShelfLocation) {
+		t.Errorf("Get(ClasOhlson) = %+v, %v", clas, ok)
+	}
+	if kiwi, _ := Stores.Get(Kiwi); kiwi.Can(Availability) {
+		t.Errorf("Kiwi should not tell its stock")
+	}
+
+	r := Stores.WithEnricher(ClasOhlson, fakeEnricher{})
+	if _, ok := r.Enrichers().For(ClasOhlson); !ok {
+		t.Errorf("expected an enricher for Clas Ohlson")
+	}
+	if _, ok := r.Enrichers().For(Kiwi); ok {
+		t.Errorf("expected no enricher for Kiwi")
+	}
+	if len(Stores.Enrichers()) != 0 {
+		t.Errorf("WithEnricher() changed the registry it was called on")
+	}
+}
@@ -1,8 +1,16 @@
 package stores
 
+// Store is the ID of a store. It's what carts are saved with, so a store
+// keeps its ID; see [Stores] for what there is to know about each.
 type Store int
 
 const (
-	Kiwi Store = iota
-	ClasOhlson
+	Kiwi       Store = 0
+	ClasOhlson Store = 1
 )
+
+// Shop is one of the physical shops of a store.
+type Shop struct {
+	ID   string
+	Name string
+}
@@ -2,97 +2,398 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
+	"time"
 
 	"github.com/kvalv/shoplist/carts"
 	"github.com/kvalv/shoplist/events"
 	"github.com/kvalv/shoplist/stores"
-	"github.com/kvalv/shoplist/stores/clasohlson"
 )
 
-func RunBackgroundWorker(
-	ctx context.Context,
-	repo *carts.SqliteRepository,
-	bus *events.Bus,
+// NewWorker returns the outbox consumer doing the background work: a first
+// cart for new users, candidates for new items in carts for a store with an
+// enricher, and fresh stock for the candidates chosen. Handling an event
+// twice is harmless, as items that have candidates are skipped.
+//
+// Items are saved one at a time, so the worker can run concurrently, see
+// [events.ConsumeOptions]. Their [carts.Enrichment] tells how far it got. A
+// failed search is returned, for the outbox to retry; once it gives up,
+// [NewWorkerFailed] marks the item.
+func NewWorker(
+	repo carts.Repository,
+	outbox *events.Outbox,
+	enrichers stores.Enrichers,
 	log *slog.Logger,
-) {
-	sub := bus.Subscribe()
-	log.Info("Started")
+) events.Handler {
+	return func(ctx context.Context, rec events.Record) error {
+		switch ev := rec.Event.(type) {
+		case events.UserRegistered:
+			log.Info("User registered", "userID", ev.UserID)
+			return repo.Save(carts.New().
+				WithName("Min første handleliste").
+				WithCreator(ev.UserID),
+			)
+
+		case events.ItemAdded:
+			return enrich(ctx, repo, outbox, enrichers, log, ev.CartID, "", ev.ItemID)
+
+		case events.ItemEnrichmentRequested:
+			return enrich(ctx, repo, outbox, enrichers, log, ev.CartID, ev.Query, ev.ItemID)
 
-	client := clasohlson.NewClient(clasohlson.CCVest)
+		case events.TargetStoreChanged:
+			return retarget(repo, outbox, enrichers, log, ev)
 
-	for {
-		select {
-		case <-ctx.Done():
-			log.Info("Done")
+		case events.StockRefreshRequested:
+			return refreshStock(ctx, repo, outbox, enrichers, log, ev.CartID)
+
+		case events.ShopChanged:
+			// the stock and shelves are those of the previous shop
+			return refreshStock(ctx, repo, outbox, enrichers, log, ev.CartID)
+
+		case events.CartUpdated:
+			// only in logs from before the item events
+			return enrich(ctx, repo, outbox, enrichers, log, ev.CartID, "", ev.ItemIDs...)
+		}
+		return nil
+	}
+}
+
+// NewWorkerFailed returns what the outbox calls when it gives up on an event
+// for the worker. The items of the event that are still without candidates,
+// or still waiting for new ones, are marked as failed, so it shows.
+func NewWorkerFailed(
+	repo carts.Repository,
+	outbox *events.Outbox,
+	log *slog.Logger,
+) func(rec events.Record, attempts int, err error) {
+	return func(rec events.Record, attempts int, cause error) {
+		var (
+			cartID  string
+			itemIDs []string
+		)
+		switch ev := rec.Event.(type) {
+		case events.ItemAdded:
+			cartID, itemIDs = ev.CartID, []string{ev.ItemID}
+		case events.ItemEnrichmentRequested:
+			cartID, itemIDs = ev.CartID, []string{ev.ItemID}
+		case events.CartUpdated:
+			cartID, itemIDs = ev.CartID, ev.ItemIDs
+		default:
 			return
-		case ev := <-sub.Ch:
-			switch ev := ev.(type) {
-			case events.UserRegistered:
-				log.Info("User registered", "userID", ev.UserID)
-				repo.Save(carts.New().
-					WithName("Min første handleliste").
-					WithCreator(ev.UserID),
-				)
-
-			case events.CartUpdated:
-				log.Info("Received event", "type", fmt.Sprintf("%T", ev), "event", ev)
-				c, err := repo.Cart(ev.CartID)
-				if err != nil {
-					log.Error("Failed to get cart", "error", err)
-					continue
-				}
-				if c.TargetStore == stores.ClasOhlson {
-					log.Info("Processing cart for Clas Ohlson", "cartID", c.ID)
-					for _, ID := range ev.ItemIDs {
-						item := c.Get(ID)
-						if item == nil {
-							log.Error("Item not found in cart", "itemID", ID)
-							continue
-						}
-						if item.Clas != nil {
-							continue
-						}
-
-						results, err := client.Query(ctx, item.Text, 5)
-						if err != nil {
-							log.Error("Failed to search items", "error", err)
-							continue
-						}
-						if len(results) == 0 {
-							log.Info("No items found", "query", item.Text)
-							continue
-						}
-
-						log.Info("Found candidates", "count", len(results), "query", item.Text)
-						for i, cl := range results {
-							locations := ""
-							for j, loc := range cl.Locations {
-								if j > 0 {
-									locations += ", "
-								}
-								locations += loc.Area + " " + loc.Shelf
-							}
-							log.Info("Candidate", "rank", i+1, "name", cl.Name, "price", cl.Price, "stock", cl.Stock, "locations", locations)
-							log.Debug("Candidate URLs", "url", cl.URL, "picture", cl.Picture)
-						}
-
-						chosen := 0
-						item.Clas = &carts.ClasSearch{
-							Candidates: results,
-							Chosen:     &chosen,
-						}
-						repo.Save(c)
-						bus.Publish(events.CartUpdated{
-							CartID:  c.ID,
-							ItemIDs: []string{item.ID},
-						})
-
-					}
-				}
+		}
 
+		c, err := repo.Cart(cartID)
+		if err != nil {
+			log.Error("Failed to get cart", "cartID", cartID, "error", err)
+			return
+		}
+		now := time.Now()
+		for _, ID := range itemIDs {
+			item := c.Get(ID)
+			if item == nil || (item.SearchIn(c.TargetStore) != nil && !item.Enrichment.Pending()) {
+				continue
+			}
+			item.Enrichment = &carts.Enrichment{
+				State:     carts.EnrichFailed,
+				Attempts:  attempts,
+				Error:     cause.Error(),
+				UpdatedAt: now,
 			}
+			err := repo.SaveItem(c.ID, item, events.ItemEnrichmentFailed{
+				CartID:   c.ID,
+				ItemID:   item.ID,
+				Attempts: attempts,
+				Error:    cause.Error(),
+				At:       now,
+			})
+			if err != nil {
+				log.Error("Failed to mark item as failed", "itemID", item.ID, "error", err)
+				continue
+			}
+			log.Warn("Gave up enriching item", "itemID", item.ID, "attempts", attempts, "error", cause)
 		}
+		outbox.Notify()
+	}
+}
+
+// retarget brings the items of a cart in line with its new store. If it has
+// an enricher, the unchecked items without candidates from it are queued,
+// each in an event of its own for the worker to pick up. If not, what was
+// left of the enrichment for the previous store is cleared. Candidates from
+// another store are kept, but not shown.
+func retarget(
+	repo carts.Repository,
+	outbox *events.Outbox,
+	enrichers stores.Enrichers,
+	log *slog.Logger,
+	ev events.TargetStoreChanged,
+) error {
+	c, err := repo.Cart(ev.CartID)
+	if err != nil {
+		return fmt.Errorf("get cart: %w", err)
+	}
+	if c.TargetStore != ev.Store {
+		// changed again since; that event takes care of it
+		return nil
+	}
+	_, ok := enrichers.For(c.TargetStore)
+
+	var queued int
+	for _, item := range c.Items {
+		var evs []events.Event
+		switch {
+		case !ok:
+			if item.Enrichment == nil {
+				continue
+			}
+			item.Enrichment = nil
+		case item.Checked || item.SearchIn(c.TargetStore) != nil || item.Enrichment.Pending():
+			continue
+		default:
+			now := time.Now()
+			item.Enrichment = &carts.Enrichment{State: carts.EnrichQueued, UpdatedAt: now}
+			evs = append(evs, events.ItemEnrichmentRequested{
+				CartID: c.ID,
+				ItemID: item.ID,
+				At:     now,
+			})
+			queued++
+		}
+		if err := repo.SaveItem(c.ID, item, evs...); err != nil {
+			return fmt.Errorf("save item: %w", err)
+		}
+	}
+	log.Info("Cart changed store", "cartID", c.ID, "store", c.TargetStore, "queued", queued)
+	outbox.Notify()
+	return nil
+}
+
+// NewStockRefreshJob returns the cron job asking for fresh stock in the recent
+// carts that are still in use, and have chosen candidates for unchecked items
+// in a store that can tell.
+func NewStockRefreshJob(
+	repo carts.Repository,
+	outbox *events.Outbox,
+	enrichers stores.Enrichers,
+	log *slog.Logger,
+) func(ctx context.Context, attempt int) error {
+	return func(ctx context.Context, attempt int) error {
+		cs, err := repo.List(5)
+		if err != nil {
+			return fmt.Errorf("list carts: %w", err)
+		}
+		for _, c := range cs {
+			if _, ok := enrichers.Refresher(c.TargetStore, ""); !ok || c.Inactive {
+				continue
+			}
+			open := slices.ContainsFunc(c.Items, func(item *carts.Item) bool {
+				return !item.Checked && item.SearchIn(c.TargetStore).Selected() != nil
+			})
+			if !open {
+				continue
+			}
+			if err := outbox.Publish(events.StockRefreshRequested{CartID: c.ID, At: time.Now()}); err != nil {
+				return fmt.Errorf("publish: %w", err)
+			}
+			log.Info("Requested stock refresh", "cartID", c.ID)
+		}
+		return nil
+	}
+}
+
+// refreshStock looks up the chosen candidate of every unchecked item in the
+// cart again, and saves those that have another stock or location now. A
+// failed lookup is returned, for the outbox to retry; the items that did not
+// change then are left alone.
+func refreshStock(
+	ctx context.Context,
+	repo carts.Repository,
+	outbox *events.Outbox,
+	enrichers stores.Enrichers,
+	log *slog.Logger,
+	cartID string,
+) error {
+	c, err := repo.Cart(cartID)
+	if err != nil {
+		return fmt.Errorf("get cart: %w", err)
+	}
+	refresher, ok := enrichers.Refresher(c.TargetStore, shopOf(repo, c))
+	if !ok {
+		return nil
+	}
+
+	var (
+		errs    []error
+		changed int
+	)
+	for _, item := range c.Items {
+		chosen := item.SearchIn(c.TargetStore).Selected()
+		if item.Checked || chosen == nil {
+			continue
+		}
+		fresh, err := refresher.Refresh(ctx, *chosen)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("refresh %q: %w", item.Text, err))
+			continue
+		}
+		if fresh.Stock == chosen.Stock && slices.Equal(fresh.Locations, chosen.Locations) && slices.Equal(fresh.Elsewhere, chosen.Elsewhere) {
+			continue
+		}
+		*chosen = fresh
+		err = repo.SaveItem(c.ID, item, events.ItemStockChanged{
+			CartID: c.ID,
+			ItemID: item.ID,
+			Stock:  fresh.Stock,
+			At:     time.Now(),
+		})
+		if err != nil {
+			return fmt.Errorf("save item: %w", err)
+		}
+		changed++
+	}
+	log.Info("Refreshed stock", "cartID", c.ID, "changed", changed, "failed", len(errs))
+	if changed > 0 {
+		outbox.Notify()
+	}
+	return errors.Join(errs...)
+}
+
+// shopOf returns the shop the cart is for, or else the one its creator
+// prefers. Empty for the default of the enricher.
+func shopOf(repo carts.Repository, c *carts.Cart) string {
+	if c.ShopID != "" || c.CreatedBy == nil {
+		return c.ShopID
+	}
+	shopID, _ := repo.ShopPreference(*c.CreatedBy, c.TargetStore)
+	return shopID
+}
+
+// enrich looks up the items in the store of the cart, by the query if set,
+// and by their own text if not.
+func enrich(
+	ctx context.Context,
+	repo carts.Repository,
+	outbox *events.Outbox,
+	enrichers stores.Enrichers,
+	log *slog.Logger,
+	cartID string,
+	query string,
+	itemIDs ...string,
+) error {
+	log.Info("Enriching items", "cartID", cartID, "itemIDs", itemIDs)
+	c, err := repo.Cart(cartID)
+	if err != nil {
+		return fmt.Errorf("get cart: %w", err)
+	}
+	enricher, ok := enrichers.At(c.TargetStore, shopOf(repo, c))
+	if !ok {
+		return nil
+	}
+
+	// a failed search doesn't stop the other items; the event is retried,
+	// and the items found in the meantime are skipped then
+	var errs []error
+	for _, ID := range itemIDs {
+		item := c.Get(ID)
+		if item == nil {
+			log.Error("Item not found in cart", "itemID", ID)
+			continue
+		}
+		// items that have candidates are only looked up when asked to
+		if item.SearchIn(c.TargetStore) != nil && !item.Enrichment.Pending() {
+			continue
+		}
+		text := item.Text
+		if query != "" {
+			text = query
+		}
+		if err := enrichItem(ctx, repo, outbox, enricher, log, c, item, text); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// enrichItem searches for candidates for the item by the text, and saves
+// them. The enrichment of the item is moved along as it goes. Finding none
+// leaves the candidates it had alone.
+func enrichItem(
+	ctx context.Context,
+	repo carts.Repository,
+	outbox *events.Outbox,
+	enricher stores.Enricher,
+	log *slog.Logger,
+	c *carts.Cart,
+	item *carts.Item,
+	text string,
+) error {
+	attempt := 1
+	if item.Enrichment != nil {
+		attempt = item.Enrichment.Attempts + 1
+	}
+	now := time.Now()
+	item.Enrichment = &carts.Enrichment{State: carts.EnrichSearching, Attempts: attempt, UpdatedAt: now}
+	err := repo.SaveItem(c.ID, item, events.ItemEnrichmentStarted{
+		CartID:  c.ID,
+		ItemID:  item.ID,
+		Attempt: attempt,
+		At:      now,
+	})
+	if err != nil {
+		return fmt.Errorf("save item: %w", err)
+	}
+	outbox.Notify()
+
+	results, err := enricher.Enrich(ctx, text)
+	if err != nil {
+		log.Error("Failed to search items", "error", err)
+		// back in the queue, until the outbox retries or gives up
+		item.Enrichment.State = carts.EnrichQueued
+		item.Enrichment.Error = err.Error()
+		item.Enrichment.UpdatedAt = time.Now()
+		if err := repo.SaveItem(c.ID, item); err != nil {
+			log.Error("Failed to save item", "itemID", item.ID, "error", err)
+		}
+		return fmt.Errorf("search %q: %w", text, err)
+	}
+
+	item.Enrichment = &carts.Enrichment{State: carts.EnrichDone, Attempts: attempt, UpdatedAt: time.Now()}
+	if len(results) == 0 {
+		log.Info("No items found", "query", text)
+		item.Enrichment.State = carts.EnrichNoMatch
+	} else {
+		log.Info("Found candidates", "count", len(results), "query", text)
+		for i, cand := range results {
+			locations := ""
+			for j, loc := range cand.Locations {
+				if j > 0 {
+					locations += ", "
+				}
+				locations += loc.Area + " " + loc.Shelf
+			}
+			log.Info("Candidate", "rank", i+1, "name", cand.Name, "price", cand.Price, "stock", cand.Stock, "locations", locations)
+			log.Debug("Candidate URLs", "url", cand.URL, "picture", cand.Picture)
+		}
+
+		chosen := 0
+		item.Search = &carts.Search{
+			Store:      c.TargetStore,
+			Candidates: results,
+			Chosen:     &chosen,
+		}
+	}
+	err = repo.SaveItem(c.ID, item, events.ItemEnriched{
+		CartID:     c.ID,
+		ItemID:     item.ID,
+		Candidates: len(results),
+		At:         item.Enrichment.UpdatedAt,
+	})
+	if err != nil {
+		return fmt.Errorf("save item: %w", err)
 	}
+	outbox.Notify()
+	return nil
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/kvalv/shoplist/carts"
+	"github.com/kvalv/shoplist/events"
+	"github.com/kvalv/shoplist/stores"
+	"github.com/kvalv/shoplist/stores/clasohlson"
+	"github.com/kvalv/shoplist/stores/clasohlson/clasohlsontest"
+	"github.com/kvalv/shoplist/stores/kiwi"
+	"github.com/kvalv/shoplist/stores/kiwi/kiwitest"
+)
+
+// newTestWorker returns storage in a temporary database, and an outbox and
+// Clas Ohlson enricher on top of it and the fake site.
+func newTestWorker(t *testing.T, srv *clasohlsontest.Server) (*storage, *events.Outbox, stores.Enrichers) {
+	t.Helper()
+	store, err := openStorage("sqlite", "file:"+filepath.Join(t.TempDir(), "shop.db"))
+	if err != nil {
+		t.Fatalf("openStorage() error: %v", err)
+	}
+	t.Cleanup(func() { store.db.Close() })
+	log := testLogger(t)
+	outbox, err := events.NewOutbox(store.db, events.NewBus(log), log)
+	if err != nil {
+		t.Fatalf("NewOutbox() error: %v", err)
+	}
+	enrichers := stores.Enrichers{
+		stores.ClasOhlson: clasohlson.NewClient(clasohlson.CCVest).
+			WithBaseURL(srv.URL).
+			WithRanking(clasohlson.RankSimple).
+			WithRateLimit(100, 100),
+	}
+	return store, outbox, enrichers
+}
+
+func testLogger(t *testing.T) *slog.Logger {
+	return slog.New(slog.NewTextHandler(t.Output(), nil))
+}
+
+func TestRefreshStock(t *testing.T) {
+	srv := clasohlsontest.NewServer(t)
+	store, outbox, enrichers := newTestWorker(t, srv)
+	repo, log := store.repo, testLogger(t)
+
+	cart := carts.New()
+	cart.TargetStore = stores.ClasOhlson
+	chosen := func(productID string) *carts.Search {
+		i := 0
+		return &carts.Search{
+			Store:      stores.ClasOhlson,
+			Candidates: []stores.Candidate{{ID: productID, Name: productID, Stock: 1}},
+			Chosen:     &i,
+		}
+	}
+	skopose := cart.Add("skopose", "")
+	skopose.Search = chosen("445689000")
+	tape := cart.Add("tape", "")
+	tape.Search = chosen("404142000")
+	tape.Checked = true
+	if err := repo.Save(cart); err != nil {
+		t.Fatalf("Save() error: %v", err)
+	}
+
+	stock := func(wantSkopose, wantTape int) {
+		t.Helper()
+		c, err := repo.Cart(cart.ID)
+		if err != nil {
+			t.Fatalf("Cart() error: %v", err)
+		}
+		got := func(ID string) int { return c.Get(ID).SearchIn(stores.ClasOhlson).Selected().Stock }
+		if got(skopose.ID) != wantSkopose || got(tape.ID) != wantTape {
+			t.Errorf("stock = %d, %d; want %d, %d", got(skopose.ID), got(tape.ID), wantSkopose, wantTape)
+		}
+	}
+	changes := func() int {
+		t.Helper()
+		history, err := store.events.History(cart.ID, 100)
+		if err != nil {
+			t.Fatalf("History() error: %v", err)
+		}
+		var n int
+		for _, rec := range history {
+			if _, ok := rec.Event.(events.ItemStockChanged); ok {
+				n++
+			}
+		}
+		return n
+	}
+
+	// checked items are left alone
+	if err := refreshStock(context.Background(), repo, outbox, enrichers, log, cart.ID); err != nil {
+		t.Fatalf("refreshStock() error: %v", err)
+	}
+	stock(42, 1)
+	if n := changes(); n != 1 {
+		t.Errorf("expected one change, got %d", n)
+	}
+
+	// nothing changed, so nothing to tell
+	if err := refreshStock(context.Background(), repo, outbox, enrichers, log, cart.ID); err != nil {
+		t.Fatalf("refreshStock() error: %v", err)
+	}
+	if n := changes(); n != 1 {
+		t.Errorf("expected no more changes, got %d", n)
+	}
+
+	// the stock is that of the shop of the cart
+	c, _ := repo.Cart(cart.ID)
+	c.ShopID = "215"
+	if err := repo.Save(c); err != nil {
+		t.Fatalf("Save() error: %v", err)
+	}
+	if err := refreshStock(context.Background(), repo, outbox, enrichers, log, cart.ID); err != nil {
+		t.Fatalf("refreshStock() error: %v", err)
+	}
+	stock(3, 1)
+}
+
+func TestRefreshStockFailed(t *testing.T) {
+	srv := clasohlsontest.NewServer(t)
+	store, outbox, enrichers := newTestWorker(t, srv)
+	log := testLogger(t)
+
+	cart := carts.New()
+	cart.TargetStore = stores.ClasOhlson
+	i := 0
+	cart.Add("skopose", "").Search = &carts.Search{
+		Store:      stores.ClasOhlson,
+		Candidates: []stores.Candidate{{ID: "445689000", Stock: 1}},
+		Chosen:     &i,
+	}
+	if err := store.repo.Save(cart); err != nil {
+		t.Fatalf("Save() error: %v", err)
+	}
+
+	// returned for the outbox to retry
+	srv.Fail(1)
+	if err := refreshStock(context.Background(), store.repo, outbox, enrichers, log, cart.ID); err == nil {
+		t.Fatalf("refreshStock() expected an error")
+	}
+	if err := refreshStock(context.Background(), store.repo, outbox, enrichers, log, cart.ID); err != nil {
+		t.Fatalf("refreshStock() error on retry: %v", err)
+	}
+}
+
+func TestEnrichWithoutLLM(t *testing.T) {
+	srv := clasohlsontest.NewServer(t)
+	store, outbox, enrichers := newTestWorker(t, srv)
+
+	cart := carts.New()
+	cart.TargetStore = stores.ClasOhlson
+	item := cart.Add("gaffatape", "")
+	if err := store.repo.Save(cart); err != nil {
+		t.Fatalf("Save() error: %v", err)
+	}
+	if err := enrich(context.Background(), store.repo, outbox, enrichers, testLogger(t), cart.ID, "", item.ID); err != nil {
+		t.Fatalf("enrich() error: %v", err)
+	}
+
+	c, err := store.repo.Cart(cart.ID)
+	if err != nil {
+		t.Fatalf("Cart() error: %v", err)
+	}
+	got := c.Get(item.ID).SearchIn(stores.ClasOhlson).Selected()
+	if got == nil || got.ID != "404142000" {
+		t.Fatalf("Selected() = %+v, want the gaffatape", got)
+	}
+}
+
+func TestEnrichKiwi(t *testing.T) {
+	store, outbox, enrichers := newTestWorker(t, clasohlsontest.NewServer(t))
+	enrichers[stores.Kiwi] = kiwi.NewClient().WithBaseURL(kiwitest.NewServer(t).URL)
+
+	cart := carts.New()
+	item := cart.Add("lettmelk", "")
+	if err := store.repo.Save(cart); err != nil {
+		t.Fatalf("Save() error: %v", err)
+	}
+	if err := enrich(context.Background(), store.repo, outbox, enrichers, testLogger(t), cart.ID, "", item.ID); err != nil {
+		t.Fatalf("enrich() error: %v", err)
+	}
+
+	c, err := store.repo.Cart(cart.ID)
+	if err != nil {
+		t.Fatalf("Cart() error: %v", err)
+	}
+	got := c.Get(item.ID).SearchIn(stores.Kiwi).Selected()
+	if got == nil || got.ID != "7038010000737" || got.UnitPrice != 24.9 || got.Unit != "l" {
+		t.Fatalf("Selected() = %+v, want the lettmelk with its unit price", got)
+	}
+}